@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+type ClientConfig struct {
+	URL    string `json:"url"`
+	Sessid string `json:"sessid"`
+}
+
+const defaultURL string = "http://localhost:8888/"
+
+func configPath() (string, error) {
+	p := os.Getenv("PASTAE_CONFIG")
+	if p != "" {
+		return p, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "pastae", "config.json"), nil
+}
+
+func readClientConfig(file string) (ClientConfig, error) {
+	config := ClientConfig{URL: defaultURL}
+	c, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return config, nil
+	}
+	if err != nil {
+		return config, err
+	}
+	err = json.Unmarshal(c, &config)
+	if err != nil {
+		return config, err
+	}
+	return config, nil
+}
+
+func writeClientConfig(file string, config ClientConfig) error {
+	err := os.MkdirAll(filepath.Dir(file), 0700)
+	if err != nil {
+		return err
+	}
+	c, err := json.MarshalIndent(config, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, c, 0600)
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type PastaeListing struct {
+	ID          string
+	Expire      int64
+	ContentType string
+}
+
+type Client struct {
+	URL    string
+	Sessid string
+	Token  string
+	HTTP   *http.Client
+}
+
+const usage string = `Usage: pastae [-url URL] <command> [arguments]
+
+Commands:
+  upload [-bar] [-expire 30] [file ...]  upload files, or stdin if none are given
+  get [-o file] <id|url>                 fetch a paste to stdout or a file
+  register [-invite code] <user>         register a user, password is read from stdin
+  login [-totp code] <user>              log in, password is read from stdin
+  logout                                 log out and forget the session
+  list                                   list pastes of the logged in user
+  delete <id> ...                        delete pastes of the logged in user
+  expiry <id> <days>                     set expiry of a paste in days
+  ping                                   keep the session alive
+  export [-o file]                       download all pastes as a zip archive
+  delete-account [-totp code]            delete the account and all pastes, password is read from stdin
+
+The password can also be given in the PASTAE_PASSWORD environment variable
+and the authenticator code in PASTAE_TOTP. An API token in PASTAE_TOKEN is
+used instead of a login session.
+Configuration is stored in $PASTAE_CONFIG or the user configuration directory.
+`
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("pastae: ")
+	fs := flag.NewFlagSet("pastae", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	serverURL := fs.String("url", "", "pastae server URL")
+	err := fs.Parse(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	cfgFile, err := configPath()
+	if err != nil {
+		log.Fatal(err)
+	}
+	config, err := readClientConfig(cfgFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *serverURL != "" {
+		config.URL = *serverURL
+	}
+	c := newClient(config.URL, config.Sessid)
+	c.Token = os.Getenv("PASTAE_TOKEN")
+	err = run(c, fs.Arg(0), fs.Args()[1:], os.Stdin, os.Stdout)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if c.Sessid != config.Sessid || *serverURL != "" {
+		config.URL = c.URL
+		config.Sessid = c.Sessid
+		err = writeClientConfig(cfgFile, config)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func newClient(url string, sessid string) *Client {
+	if !strings.HasSuffix(url, "/") {
+		url += "/"
+	}
+	return &Client{URL: url, Sessid: sessid, HTTP: &http.Client{Timeout: 60 * time.Second}}
+}
+
+func run(c *Client, cmd string, args []string, stdin io.Reader, stdout io.Writer) error {
+	switch cmd {
+	case "upload":
+		fs := flag.NewFlagSet("upload", flag.ExitOnError)
+		bar := fs.Bool("bar", false, "burn after reading")
+		expire := fs.String("expire", "", "expire in days (30), only for logged in users")
+		err := fs.Parse(args)
+		if err != nil {
+			return err
+		}
+		files := fs.Args()
+		if len(files) == 0 {
+			files = []string{"-"}
+		}
+		for _, f := range files {
+			var data []byte
+			if f == "-" {
+				data, err = io.ReadAll(stdin)
+			} else {
+				data, err = os.ReadFile(f)
+			}
+			if err != nil {
+				return err
+			}
+			pasteURL, err := c.upload(data, filepath.Base(f), *bar, *expire)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(stdout, pasteURL)
+		}
+		return nil
+	case "get":
+		fs := flag.NewFlagSet("get", flag.ExitOnError)
+		out := fs.String("o", "", "output file")
+		err := fs.Parse(args)
+		if err != nil {
+			return err
+		}
+		if fs.NArg() != 1 {
+			return errors.New("get needs exactly one paste id")
+		}
+		data, err := c.get(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		if *out != "" {
+			return os.WriteFile(*out, data, 0600)
+		}
+		_, err = stdout.Write(data)
+		return err
+	case "register", "login":
+		fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+		totp := fs.String("totp", os.Getenv("PASTAE_TOTP"), "authenticator or recovery code")
+		invite := fs.String("invite", "", "invite code")
+		err := fs.Parse(args)
+		if err != nil {
+			return err
+		}
+		if fs.NArg() != 1 {
+			return errors.New(cmd + " needs exactly one user name")
+		}
+		password, err := readPassword(stdin)
+		if err != nil {
+			return err
+		}
+		if cmd == "register" {
+			pending, err := c.register(fs.Arg(0), password, *invite)
+			if err == nil && pending {
+				fmt.Fprintln(stdout, "account awaits approval")
+			}
+			return err
+		}
+		return c.login(fs.Arg(0), password, *totp)
+	case "logout":
+		return c.logout()
+	case "list":
+		listing, err := c.list()
+		if err != nil {
+			return err
+		}
+		for _, l := range listing {
+			expire := "never"
+			if l.Expire > 0 {
+				expire = time.Unix(l.Expire*60*60*24, 0).UTC().Format("2006-01-02")
+			}
+			fmt.Fprintf(stdout, "%s%s\t%s\t%s\n", c.URL, l.ID, l.ContentType, expire)
+		}
+		return nil
+	case "delete":
+		if len(args) == 0 {
+			return errors.New("delete needs at least one paste id")
+		}
+		for _, id := range args {
+			err := c.delete(id)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case "expiry":
+		if len(args) != 2 {
+			return errors.New("expiry needs a paste id and days")
+		}
+		return c.expiry(args[0], args[1])
+	case "ping":
+		return c.ping()
+	case "export":
+		fs := flag.NewFlagSet("export", flag.ExitOnError)
+		out := fs.String("o", "", "output file")
+		err := fs.Parse(args)
+		if err != nil {
+			return err
+		}
+		data, err := c.do(http.MethodPost, "session/export", "", nil)
+		if err != nil {
+			return err
+		}
+		if *out != "" {
+			return os.WriteFile(*out, data, 0600)
+		}
+		_, err = stdout.Write(data)
+		return err
+	case "delete-account":
+		fs := flag.NewFlagSet("delete-account", flag.ExitOnError)
+		totp := fs.String("totp", os.Getenv("PASTAE_TOTP"), "authenticator or recovery code")
+		err := fs.Parse(args)
+		if err != nil {
+			return err
+		}
+		password, err := readPassword(stdin)
+		if err != nil {
+			return err
+		}
+		v := url.Values{"password": {password}}
+		if *totp != "" {
+			v.Set("totp", *totp)
+		}
+		_, err = c.do(http.MethodPost, "session/delete", "application/x-www-form-urlencoded",
+			strings.NewReader(v.Encode()))
+		if err == nil {
+			c.Sessid = ""
+		}
+		return err
+	}
+	return errors.New("unknown command " + cmd)
+}
+
+func readPassword(stdin io.Reader) (string, error) {
+	password := os.Getenv("PASTAE_PASSWORD")
+	if password != "" {
+		return password, nil
+	}
+	line, err := bufio.NewReader(stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	password = strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", errors.New("empty password")
+	}
+	return password, nil
+}
+
+// credentials encodes a login or registration form, extra is the TOTP code of
+// a login or the invite code of a registration
+func credentials(user string, password string, field string, extra string) io.Reader {
+	v := url.Values{"username": {user}, "password": {password}}
+	if extra != "" {
+		v.Set(field, extra)
+	}
+	return strings.NewReader(v.Encode())
+}
+
+func pasteID(id string) string {
+	return id[strings.LastIndex(id, "/")+1:]
+}
+
+func (c *Client) do(method string, path string, contentType string, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequest(method, c.URL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("content-type", contentType)
+	}
+	if c.Sessid != "" {
+		req.Header.Set("pastae-sessid", c.Sessid)
+	} else if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		ec := resp.Body.Close()
+		if ec != nil {
+			log.Println(ec.Error())
+		}
+	}()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("%s /%s: %s", method, path, resp.Status)
+	}
+	return data, nil
+}
+
+func (c *Client) upload(data []byte, fileName string, bar bool, expire string) (string, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	var err error
+	if strings.HasPrefix(http.DetectContentType(data), "text/plain") {
+		err = mw.WriteField("content-type", "text/plain")
+		if err == nil {
+			err = mw.WriteField("data", string(data))
+		}
+	} else {
+		var fw io.Writer
+		fw, err = mw.CreateFormFile("file", fileName)
+		if err == nil {
+			_, err = fw.Write(data)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	if bar {
+		err = mw.WriteField("bar", "bar")
+		if err != nil {
+			return "", err
+		}
+	}
+	if expire != "" {
+		err = mw.WriteField("expire", expire)
+		if err != nil {
+			return "", err
+		}
+	}
+	err = mw.Close()
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.do(http.MethodPost, "upload", mw.FormDataContentType(), &body)
+	if err != nil {
+		return "", err
+	}
+	return string(resp), nil
+}
+
+func (c *Client) get(id string) ([]byte, error) {
+	return c.do(http.MethodGet, pasteID(id), "", nil)
+}
+
+func (c *Client) register(user string, password string, invite string) (bool, error) {
+	resp, err := c.do(http.MethodPost, "session/register", "application/x-www-form-urlencoded",
+		credentials(user, password, "invite", invite))
+	return string(resp) == "PENDING", err
+}
+
+func (c *Client) login(user string, password string, totp string) error {
+	c.Sessid = ""
+	resp, err := c.do(http.MethodPost, "session/login", "application/x-www-form-urlencoded",
+		credentials(user, password, "totp", totp))
+	if err != nil {
+		return err
+	}
+	c.Sessid = string(resp)
+	return nil
+}
+
+func (c *Client) logout() error {
+	if c.Sessid == "" {
+		return nil
+	}
+	_, err := c.do(http.MethodPost, "session/logout", "", strings.NewReader(c.Sessid))
+	c.Sessid = ""
+	return err
+}
+
+func (c *Client) list() ([]PastaeListing, error) {
+	resp, err := c.do(http.MethodPost, "session/list", "", nil)
+	if err != nil {
+		return nil, err
+	}
+	var listing []PastaeListing
+	err = json.Unmarshal(resp, &listing)
+	if err != nil {
+		return nil, err
+	}
+	return listing, nil
+}
+
+func (c *Client) delete(id string) error {
+	_, err := c.do(http.MethodDelete, pasteID(id), "", nil)
+	return err
+}
+
+func (c *Client) expiry(id string, days string) error {
+	_, err := c.do(http.MethodPost, "expiry/"+pasteID(id)+"/"+days, "", nil)
+	return err
+}
+
+func (c *Client) ping() error {
+	_, err := c.do(http.MethodPost, "session/ping", "", nil)
+	return err
+}
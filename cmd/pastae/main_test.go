@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/upload":
+			err := r.ParseMultipartForm(1024)
+			if err != nil {
+				t.Error(err)
+			}
+			if r.FormValue("content-type") != "text/plain" || r.FormValue("data") != "Trololoo" {
+				t.Error("Invalid upload form")
+			}
+			if r.FormValue("bar") != "bar" || r.FormValue("expire") != "30" {
+				t.Error("Upload options missing")
+			}
+			_, _ = w.Write([]byte("http://pastae/abc.txt"))
+		case "/session/login":
+			if r.PostFormValue("username") != "ahto" || r.PostFormValue("password") != "simakuutio" ||
+				r.PostFormValue("totp") != "123456" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_, _ = w.Write([]byte("sessid"))
+		case "/session/list":
+			if r.Header.Get("pastae-sessid") != "sessid" && r.Header.Get("Authorization") != "Bearer pastae_token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_, _ = w.Write([]byte(`[{"ID":"abc.txt","Expire":0,"ContentType":"text/plain;charset=utf-8"}]`))
+		case "/abc.txt":
+			if r.Method == http.MethodDelete && r.Header.Get("pastae-sessid") != "sessid" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_, _ = w.Write([]byte("Trololoo"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestClientCommands(t *testing.T) {
+	s := testServer(t)
+	defer s.Close()
+	c := newClient(s.URL, "")
+	var out bytes.Buffer
+	err := run(c, "upload", []string{"-bar", "-expire", "30"}, strings.NewReader("Trololoo"), &out)
+	if err != nil || out.String() != "http://pastae/abc.txt\n" {
+		t.Error("Upload failed", err)
+	}
+	out.Reset()
+	err = run(c, "get", []string{"http://pastae/abc.txt"}, nil, &out)
+	if err != nil || out.String() != "Trololoo" {
+		t.Error("Get failed", err)
+	}
+	err = run(c, "login", []string{"ahto"}, strings.NewReader("wrong\n"), &out)
+	if err == nil || c.Sessid != "" {
+		t.Error("Invalid login accepted")
+	}
+	err = run(c, "login", []string{"ahto"}, strings.NewReader("simakuutio\n"), &out)
+	if err == nil || c.Sessid != "" {
+		t.Error("Login without TOTP code accepted")
+	}
+	err = run(c, "login", []string{"-totp", "123456", "ahto"}, strings.NewReader("simakuutio\n"), &out)
+	if err != nil || c.Sessid != "sessid" {
+		t.Error("Login failed", err)
+	}
+	out.Reset()
+	err = run(c, "list", nil, nil, &out)
+	if err != nil || !strings.HasPrefix(out.String(), s.URL+"/abc.txt\t") {
+		t.Error("List failed", err, out.String())
+	}
+	err = run(c, "delete", []string{"abc.txt"}, nil, &out)
+	if err != nil {
+		t.Error(err)
+	}
+	c = newClient(s.URL, "")
+	c.Token = "pastae_token"
+	out.Reset()
+	err = run(c, "list", nil, nil, &out)
+	if err != nil || !strings.HasPrefix(out.String(), s.URL+"/abc.txt\t") {
+		t.Error("List with API token failed", err)
+	}
+	err = run(c, "wololo", nil, nil, &out)
+	if err == nil {
+		t.Error("Unknown command accepted")
+	}
+}
+
+func TestClientConfig(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "pastae", "config.json")
+	config, err := readClientConfig(file)
+	if err != nil || config.URL != defaultURL {
+		t.Error("Missing config not defaulted")
+	}
+	config.Sessid = "sessid"
+	err = writeClientConfig(file, config)
+	if err != nil {
+		t.Error(err)
+	}
+	config, err = readClientConfig(file)
+	if err != nil || config.Sessid != "sessid" {
+		t.Error("Config not persisted")
+	}
+}
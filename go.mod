@@ -5,8 +5,10 @@ go 1.24.0
 toolchain go1.24.2
 
 require (
-	github.com/glebarez/go-sqlite v1.22.0
 	github.com/julienschmidt/httprouter v1.3.0
+	github.com/lib/pq v1.9.0
+	golang.org/x/crypto v0.43.0
+	modernc.org/sqlite v1.39.1
 )
 
 require (
@@ -20,5 +22,4 @@ require (
 	modernc.org/libc v1.66.10 // indirect
 	modernc.org/mathutil v1.7.1 // indirect
 	modernc.org/memory v1.11.0 // indirect
-	modernc.org/sqlite v1.39.1 // indirect
 )
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// ExportManifest describes a paste in a data export
+type ExportManifest struct {
+	ID          string `json:"pid"`
+	ContentType string `json:"contentType"`
+	Expire      int64  `json:"expire,omitempty"`
+	Name        string `json:"name,omitempty"`
+	File        string `json:"file"`
+}
+
+// exportPastes writes all readable pastes of a user decrypted to a zip archive
+// with a manifest.json listing them
+func exportPastes(db *sql.DB, uid int64, kek []byte, out io.Writer) error {
+	res, err := db.Query("SELECT pid_enc, fname, key, nonce, ct, COALESCE(expire,0), COALESCE(name,'') "+
+		"FROM data WHERE uid = $1 ORDER BY id", uid)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		ec := res.Close()
+		if ec != nil {
+			log.Println(ec.Error())
+		}
+	}()
+	zw := zip.NewWriter(out)
+	manifest := []ExportManifest{}
+	for res.Next() {
+		var pidEnc, key, nonce []byte
+		var fname string
+		var elem ExportManifest
+		err = res.Scan(&pidEnc, &fname, &key, &nonce, &elem.ContentType, &elem.Expire, &elem.Name)
+		if err != nil {
+			return err
+		}
+		// a paste that can not be read is left out like in the paste list,
+		// the archive is already being sent
+		pid, err := openWithKek(pidEnc, kek)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		elem.ID = string(pid)
+		data, err := readPasteFile(fname, key, nonce, elem.ID)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		elem.File = "pastes/" + path.Base(elem.ID)
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: elem.File, Method: zip.Deflate, Modified: time.Now()})
+		if err == nil {
+			_, err = fw.Write(data)
+		}
+		zeroByteArray(data)
+		if err != nil {
+			return err
+		}
+		manifest = append(manifest, elem)
+	}
+	err = res.Err()
+	if err != nil {
+		return err
+	}
+	fw, err := zw.Create("manifest.json")
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(fw)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(manifest)
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// confirmAccount checks the password and second factor of a user before
+// destructive account operations. Single sign-on users have no password.
+func confirmAccount(db *sql.DB, uid int64, password string, code string) error {
+	var hasPassword bool
+	err := db.QueryRow("SELECT password IS NOT NULL FROM users WHERE id = $1", uid).Scan(&hasPassword)
+	if err != nil {
+		return err
+	}
+	if !hasPassword {
+		return nil
+	}
+	return verifyUserSecondFactor(db, uid, password, code)
+}
+
+// deleteAccount removes a user with all pastes, data files, sessions and API
+// tokens. The KEK is only stored in the rows deleted here.
+func deleteAccount(db *sql.DB, uid int64) error {
+	if CONFIGURATION.DatabasePersistUser != "" {
+		var persist bool
+		err := db.QueryRow("SELECT hash = $1 FROM users WHERE id = $2",
+			CONFIGURATION.DatabasePersistUser, uid).Scan(&persist)
+		if err != nil {
+			return err
+		}
+		if persist {
+			return errors.New("persist user can not be deleted")
+		}
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	rollback := func(err error) error {
+		ec := tx.Rollback()
+		if ec != nil {
+			log.Println(ec.Error())
+		}
+		return err
+	}
+	res, err := tx.Query("DELETE FROM data WHERE uid = $1 RETURNING fname", uid)
+	if err != nil {
+		return rollback(err)
+	}
+	var fnames []string
+	for res.Next() {
+		var fname string
+		err = res.Scan(&fname)
+		if err != nil {
+			ec := res.Close()
+			if ec != nil {
+				log.Println(ec.Error())
+			}
+			return rollback(err)
+		}
+		fnames = append(fnames, fname)
+	}
+	err = res.Close()
+	if err != nil {
+		return rollback(err)
+	}
+	// overwrite the wrapped KEK before deleting the row
+	for _, q := range []string{"DELETE FROM sessions WHERE uid = $1", "DELETE FROM tokens WHERE uid = $1",
+		"UPDATE users SET kek = " + zeroBlob("kek") + " WHERE id = $1", "DELETE FROM users WHERE id = $1"} {
+		_, err = tx.Exec(q, uid)
+		if err != nil {
+			return rollback(err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	SESSIONPASTECOUNT.Add(-int64(len(fnames)))
+	for _, fname := range fnames {
+		removeDataFile(fname)
+	}
+	return nil
+}
+
+// persistUser reports whether uid is DatabasePersistUser, which holds the
+// anonymous uploads of everyone and is not anybody's account
+func persistUser(db *sql.DB, uid int64) bool {
+	if CONFIGURATION.DatabasePersistUser == "" {
+		return false
+	}
+	var id int64
+	err := db.QueryRow("SELECT id FROM users WHERE hash = $1", CONFIGURATION.DatabasePersistUser).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false
+	}
+	if err != nil {
+		log.Println(err)
+		return true
+	}
+	return id == uid
+}
+
+func exportHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if r == nil {
+		log.Println("http.Request is nil")
+		return
+	}
+	defer func() {
+		ec := r.Body.Close()
+		if ec != nil {
+			log.Println(ec.Error())
+		}
+	}()
+	sessid := sessionToken(r)
+	if sessid == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	uid, kek, err := sessionValid(DB, sessid, scopeSession)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if persistUser(DB, uid) {
+		zeroByteArray(kek)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	defer zeroByteArray(kek)
+	w.Header().Set("content-type", "application/zip")
+	w.Header().Set("content-disposition", `attachment; filename="pastae-export.zip"`)
+	err = exportPastes(DB, uid, kek, w)
+	if err != nil {
+		// the archive is incomplete, the client sees a broken zip
+		log.Println(err)
+	}
+}
+
+// deleteAccountHandler reads form fields password and totp to confirm
+func deleteAccountHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if r == nil {
+		log.Println("http.Request is nil")
+		return
+	}
+	defer func() {
+		ec := r.Body.Close()
+		if ec != nil {
+			log.Println(ec.Error())
+		}
+	}()
+	sessid := sessionToken(r)
+	if sessid == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	uid, kek, err := sessionValid(DB, sessid, scopeSession)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if persistUser(DB, uid) {
+		zeroByteArray(kek)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	zeroByteArray(kek)
+	r.Body = http.MaxBytesReader(w, r.Body, 4096)
+	err = r.ParseMultipartForm(4096)
+	if err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	err = confirmAccount(DB, uid, r.PostFormValue("password"), r.PostFormValue("totp"))
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	err = deleteAccount(DB, uid)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	clearSessionCookies(w, r)
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,1111 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const apiPrefix string = "/api/v1"
+
+type ApiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type ApiResponse struct {
+	Data  any       `json:"data,omitempty"`
+	Error *ApiError `json:"error,omitempty"`
+}
+
+type ApiPasteRequest struct {
+	Content          string `json:"content,omitempty"`
+	Data             []byte `json:"data,omitempty"`
+	ContentType      string `json:"contentType,omitempty"`
+	Name             string `json:"name,omitempty"`
+	BurnAfterReading bool   `json:"burnAfterReading"`
+	ExpireDays       int64  `json:"expireDays,omitempty"`
+}
+
+type ApiPaste struct {
+	ID          string `json:"id"`
+	URL         string `json:"url"`
+	DeleteToken string `json:"deleteToken,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+	Name        string `json:"name,omitempty"`
+	Expire      int64  `json:"expire,omitempty"`
+	Pinned      bool   `json:"pinned,omitempty"`
+}
+
+type ApiPasteList struct {
+	Items   []ApiPaste `json:"items"`
+	Page    int64      `json:"page"`
+	PerPage int64      `json:"perPage"`
+	Total   int64      `json:"total"`
+	Usage   ApiUsage   `json:"usage"`
+}
+
+// ApiUsage is the storage used by a user, limits of 0 are unlimited
+type ApiUsage struct {
+	Entries    int64 `json:"entries"`
+	Bytes      int64 `json:"bytes"`
+	MaxEntries int64 `json:"maxEntries"`
+	MaxBytes   int64 `json:"maxBytes"`
+}
+
+// ApiQuota overrides the limits of a user, null restores the default
+type ApiQuota struct {
+	MaxEntries *int64 `json:"maxEntries"`
+	MaxBytes   *int64 `json:"maxBytes"`
+}
+
+type ApiExpiryRequest struct {
+	Days int64 `json:"days"`
+}
+
+type ApiCredentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Totp     string `json:"totp,omitempty"`
+	Invite   string `json:"invite,omitempty"`
+}
+
+type ApiPasswordChange struct {
+	Password    string `json:"password"`
+	NewPassword string `json:"newPassword"`
+}
+
+type ApiTotpSetup struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+type ApiTotpCode struct {
+	Code string `json:"code"`
+}
+
+type ApiTotpDisable struct {
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+type ApiRecoveryCodes struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+type ApiTokenRequest struct {
+	Name       string   `json:"name,omitempty"`
+	Scopes     []string `json:"scopes"`
+	ExpireDays int64    `json:"expireDays,omitempty"`
+}
+
+type ApiToken struct {
+	Token string `json:"token"`
+}
+
+type ApiTokenInfo struct {
+	ID       int64    `json:"id"`
+	Name     string   `json:"name,omitempty"`
+	Scopes   []string `json:"scopes"`
+	Created  int64    `json:"created"`
+	Expire   int64    `json:"expire,omitempty"`
+	LastUsed int64    `json:"lastUsed,omitempty"`
+}
+
+type ApiAccountDeletion struct {
+	Password string `json:"password,omitempty"`
+	Totp     string `json:"totp,omitempty"`
+}
+
+type ApiInviteRequest struct {
+	MaxUses    int64 `json:"maxUses,omitempty"`
+	ExpireDays int64 `json:"expireDays,omitempty"`
+}
+
+type ApiInvite struct {
+	Code string `json:"code"`
+}
+
+type ApiInviteInfo struct {
+	ID      int64 `json:"id"`
+	MaxUses int64 `json:"maxUses"`
+	Uses    int64 `json:"uses"`
+	Created int64 `json:"created"`
+	Expire  int64 `json:"expire,omitempty"`
+}
+
+type ApiPendingUser struct {
+	ID       int64  `json:"id"`
+	Username string `json:"username"`
+}
+
+type ApiSession struct {
+	SessionID string `json:"sessionId"`
+}
+
+type ApiSessionInfo struct {
+	ID        int64  `json:"id"`
+	Created   int64  `json:"created"`
+	LastSeen  int64  `json:"lastSeen"`
+	UserAgent string `json:"userAgent,omitempty"`
+	Current   bool   `json:"current"`
+}
+
+// ApiRoute describes an API endpoint. The route table is used both for
+// routing and for generating the OpenAPI document.
+type ApiRoute struct {
+	Method   string
+	Path     string
+	Summary  string
+	Session  bool
+	Scope    string
+	Status   int
+	Request  any
+	Response any
+	Handler  httprouter.Handle
+}
+
+const apiMaxPerPage int64 = 500
+const apiDefaultPerPage int64 = 50
+
+func apiRoutes() []ApiRoute {
+	routes := []ApiRoute{
+		{Method: http.MethodGet, Path: "/openapi.json", Summary: "OpenAPI description of this API",
+			Status: http.StatusOK, Handler: apiOpenAPI},
+		{Method: http.MethodPost, Path: "/pastes", Summary: "Create a paste",
+			Status: http.StatusCreated, Request: ApiPasteRequest{}, Response: ApiPaste{}, Handler: apiCreatePaste},
+	}
+	if !CONFIGURATION.Database {
+		return routes
+	}
+	return append(routes, []ApiRoute{
+		{Method: http.MethodGet, Path: "/pastes", Summary: "List pastes of the session user",
+			Session: true, Scope: scopeList, Status: http.StatusOK, Response: ApiPasteList{}, Handler: apiListPastes},
+		{Method: http.MethodDelete, Path: "/pastes/:id", Summary: "Delete a paste",
+			Session: true, Scope: scopeDelete, Status: http.StatusNoContent, Handler: apiDeletePaste},
+		{Method: http.MethodPut, Path: "/pastes/:id/expiry", Summary: "Set paste expiry",
+			Session: true, Scope: scopeExpiry, Status: http.StatusNoContent, Request: ApiExpiryRequest{},
+			Handler: apiSetExpiry},
+		{Method: http.MethodPut, Path: "/pastes/:id/pin", Summary: "Pin a paste, pinned pastes are never evicted",
+			Session: true, Scope: scopeExpiry, Status: http.StatusNoContent, Handler: apiPin(true)},
+		{Method: http.MethodDelete, Path: "/pastes/:id/pin", Summary: "Unpin a paste",
+			Session: true, Scope: scopeExpiry, Status: http.StatusNoContent, Handler: apiPin(false)},
+		{Method: http.MethodPost, Path: "/users", Summary: "Register a user, 202 when the account awaits approval",
+			Status: http.StatusNoContent, Request: ApiCredentials{}, Handler: apiRegister},
+		{Method: http.MethodPut, Path: "/users/current/password", Summary: "Change the password of the session user",
+			Session: true, Status: http.StatusNoContent, Request: ApiPasswordChange{}, Handler: apiChangePassword},
+		{Method: http.MethodGet, Path: "/users/current/export", Summary: "Export all pastes as a zip archive",
+			Session: true, Status: http.StatusOK, Handler: apiExport},
+		{Method: http.MethodDelete, Path: "/users/current", Summary: "Delete the account with all pastes",
+			Session: true, Status: http.StatusNoContent, Request: ApiAccountDeletion{}, Handler: apiDeleteAccount},
+		{Method: http.MethodPost, Path: "/users/current/totp", Summary: "Start TOTP enrollment",
+			Session: true, Status: http.StatusCreated, Response: ApiTotpSetup{}, Handler: apiTotpSetup},
+		{Method: http.MethodPut, Path: "/users/current/totp", Summary: "Enable TOTP with a code from the authenticator",
+			Session: true, Status: http.StatusOK, Request: ApiTotpCode{}, Response: ApiRecoveryCodes{},
+			Handler: apiTotpEnable},
+		{Method: http.MethodDelete, Path: "/users/current/totp", Summary: "Disable TOTP",
+			Session: true, Status: http.StatusNoContent, Request: ApiTotpDisable{}, Handler: apiTotpDisable},
+		{Method: http.MethodPost, Path: "/sessions", Summary: "Log in",
+			Status: http.StatusCreated, Request: ApiCredentials{}, Response: ApiSession{}, Handler: apiLogin},
+		{Method: http.MethodGet, Path: "/sessions", Summary: "List active sessions of the session user",
+			Session: true, Status: http.StatusOK, Response: []ApiSessionInfo{}, Handler: apiListSessions},
+		{Method: http.MethodDelete, Path: "/sessions/:id", Summary: "Revoke a session, current logs out",
+			Session: true, Status: http.StatusNoContent, Handler: apiRevokeSession},
+		{Method: http.MethodPost, Path: "/sessions/current/ping", Summary: "Keep the session alive",
+			Session: true, Status: http.StatusNoContent, Handler: apiPing},
+		{Method: http.MethodGet, Path: "/tokens", Summary: "List API tokens of the session user",
+			Session: true, Status: http.StatusOK, Response: []ApiTokenInfo{}, Handler: apiListTokens},
+		{Method: http.MethodPost, Path: "/tokens", Summary: "Create an API token",
+			Session: true, Status: http.StatusCreated, Request: ApiTokenRequest{}, Response: ApiToken{},
+			Handler: apiCreateToken},
+		{Method: http.MethodDelete, Path: "/tokens/:id", Summary: "Revoke an API token",
+			Session: true, Status: http.StatusNoContent, Handler: apiRevokeToken},
+		{Method: http.MethodGet, Path: "/admin/invites", Summary: "List invite codes",
+			Session: true, Status: http.StatusOK, Response: []ApiInviteInfo{}, Handler: apiListInvites},
+		{Method: http.MethodPost, Path: "/admin/invites", Summary: "Create an invite code",
+			Session: true, Status: http.StatusCreated, Request: ApiInviteRequest{}, Response: ApiInvite{},
+			Handler: apiCreateInvite},
+		{Method: http.MethodDelete, Path: "/admin/invites/:id", Summary: "Delete an invite code",
+			Session: true, Status: http.StatusNoContent, Handler: apiAdminAction(deleteInvite)},
+		{Method: http.MethodGet, Path: "/admin/users/pending", Summary: "List users awaiting approval",
+			Session: true, Status: http.StatusOK, Response: []ApiPendingUser{}, Handler: apiListPendingUsers},
+		{Method: http.MethodPost, Path: "/admin/users/:id/approve", Summary: "Approve a pending user",
+			Session: true, Status: http.StatusNoContent, Handler: apiAdminAction(approveUser)},
+		{Method: http.MethodDelete, Path: "/admin/users/:id", Summary: "Reject a pending user",
+			Session: true, Status: http.StatusNoContent, Handler: apiAdminAction(rejectUser)},
+		{Method: http.MethodPut, Path: "/admin/users/:id/quota", Summary: "Set the storage quota of a user",
+			Session: true, Status: http.StatusNoContent, Request: ApiQuota{}, Handler: apiSetQuota},
+	}...)
+}
+
+func apiRouter() *httprouter.Router {
+	mux := httprouter.New()
+	for _, route := range apiRoutes() {
+		mux.Handle(route.Method, route.Path, route.Handler)
+	}
+	mux.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiWriteError(w, http.StatusNotFound, "not_found", "no such endpoint")
+	})
+	mux.MethodNotAllowed = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiWriteError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+	})
+	mux.PanicHandler = func(w http.ResponseWriter, r *http.Request, v any) {
+		log.Println(v)
+		apiWriteError(w, http.StatusInternalServerError, "internal", "internal error")
+	}
+	return mux
+}
+
+// newHandler combines the legacy routes with the versioned API
+func newHandler(legacy http.Handler) http.Handler {
+	root := http.NewServeMux()
+	root.Handle(apiPrefix+"/", http.StripPrefix(apiPrefix, apiRouter()))
+	if oidcEnabled() {
+		root.Handle("/session/oidc/", oidcRouter())
+	}
+	root.Handle("/", legacy)
+	return root
+}
+
+func apiWrite(w http.ResponseWriter, status int, data any) {
+	if status == http.StatusNoContent {
+		w.WriteHeader(status)
+		return
+	}
+	bytes, err := json.Marshal(ApiResponse{Data: data})
+	if err != nil {
+		log.Println(err)
+		apiWriteError(w, http.StatusInternalServerError, "internal", "internal error")
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write(bytes)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+func apiWriteError(w http.ResponseWriter, status int, code string, message string) {
+	bytes, err := json.Marshal(ApiResponse{Error: &ApiError{Code: code, Message: message}})
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write(bytes)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+func apiDecode(w http.ResponseWriter, r *http.Request, limit int64, v any) bool {
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, limit)).Decode(v)
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			apiWriteError(w, http.StatusRequestEntityTooLarge, "too_large", "request body too large")
+		} else {
+			apiWriteError(w, http.StatusBadRequest, "invalid_request", "invalid JSON body")
+		}
+		return false
+	}
+	return true
+}
+
+func apiTooManyRequests(w http.ResponseWriter, wait int64) {
+	w.Header().Set("Retry-After", strconv.FormatInt(wait, 10))
+	apiWriteError(w, http.StatusTooManyRequests, "too_many_requests", "too many attempts, retry later")
+}
+
+func apiSession(w http.ResponseWriter, r *http.Request, scope string) (int64, []byte, bool) {
+	token := sessionToken(r)
+	if token == "" {
+		apiWriteError(w, http.StatusUnauthorized, "unauthorized", "invalid session")
+		return 0, nil, false
+	}
+	uid, kek, err := sessionValid(DB, token, scope)
+	if err != nil {
+		apiWriteError(w, http.StatusUnauthorized, "unauthorized", "invalid session")
+		return 0, nil, false
+	}
+	return uid, kek, true
+}
+
+func apiCreatePaste(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	defer func() {
+		ec := r.Body.Close()
+		if ec != nil {
+			log.Println(ec.Error())
+		}
+	}()
+	maxEntrySize := CONFIGURATION.MaxEntrySize
+	if CONFIGURATION.Database {
+		maxEntrySize = CONFIGURATION.DatabaseMaxEntrySize
+	}
+	var req ApiPasteRequest
+	// base64 encoding of data needs a third more room
+	if !apiDecode(w, r, maxEntrySize*4/3+1024, &req) {
+		return
+	}
+	data := req.Data
+	contentType := req.ContentType
+	if req.Content != "" {
+		data = []byte(req.Content)
+		contentType = "text/plain"
+	}
+	if len(data) == 0 {
+		apiWriteError(w, http.StatusBadRequest, "invalid_request", "content or data is required")
+		return
+	}
+	if int64(len(data)) > maxEntrySize {
+		apiWriteError(w, http.StatusRequestEntityTooLarge, "too_large", "paste too large")
+		return
+	}
+	if req.ExpireDays < 0 {
+		apiWriteError(w, http.StatusBadRequest, "invalid_request", "expireDays must not be negative")
+		return
+	}
+	name := pasteName(req.Name)
+	url, token, err := createPaste(data, contentType, req.BurnAfterReading, CONFIGURATION.Database,
+		sessionToken(r), req.ExpireDays, name)
+	zeroByteArray(data)
+	if err != nil {
+		switch err {
+		case errUnauthorized:
+			apiWriteError(w, http.StatusUnauthorized, "unauthorized", "invalid session")
+		case errContentType:
+			apiWriteError(w, http.StatusUnsupportedMediaType, "unsupported_content_type", "unsupported content type")
+		case errQuotaExceeded:
+			apiWriteError(w, http.StatusForbidden, "quota_exceeded", "storage quota exceeded")
+		case errStorageFull:
+			apiWriteError(w, http.StatusInsufficientStorage, "storage_full", "storage full")
+		default:
+			log.Println(err)
+			apiWriteError(w, http.StatusInternalServerError, "internal", "storing paste failed")
+		}
+		return
+	}
+	apiWrite(w, http.StatusCreated, ApiPaste{ID: strings.TrimPrefix(url, CONFIGURATION.URL),
+		URL: url, DeleteToken: token, Name: name})
+}
+
+func apiListPastes(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	uid, kek, ok := apiSession(w, r, scopeList)
+	if !ok {
+		return
+	}
+	page, err := apiQueryInt(r, "page", 1)
+	if err != nil || page < 1 {
+		apiWriteError(w, http.StatusBadRequest, "invalid_request", "invalid page")
+		return
+	}
+	perPage, err := apiQueryInt(r, "perPage", apiDefaultPerPage)
+	if err != nil || perPage < 1 || perPage > apiMaxPerPage {
+		apiWriteError(w, http.StatusBadRequest, "invalid_request", "invalid perPage")
+		return
+	}
+	q, err := userQuota(DB, uid)
+	if err != nil {
+		log.Println(err)
+		apiWriteError(w, http.StatusInternalServerError, "internal", "listing failed")
+		return
+	}
+	resp := ApiPasteList{Items: []ApiPaste{}, Page: page, PerPage: perPage, Total: q.Entries,
+		Usage: ApiUsage{Entries: q.Entries, Bytes: q.Bytes, MaxEntries: q.MaxEntries, MaxBytes: q.MaxBytes}}
+	res, err := DB.Query("SELECT pid_enc,COALESCE(expire,0),ct,COALESCE(name,''),pinned FROM data WHERE uid = $1 "+
+		"ORDER BY id LIMIT $2 OFFSET $3", uid, perPage, (page-1)*perPage)
+	if err != nil {
+		log.Println(err)
+		apiWriteError(w, http.StatusInternalServerError, "internal", "listing failed")
+		return
+	}
+	defer func() {
+		ec := res.Close()
+		if ec != nil {
+			log.Println(ec.Error())
+		}
+	}()
+	for res.Next() {
+		var elem ApiPaste
+		var pidEnc []byte
+		err = res.Scan(&pidEnc, &elem.Expire, &elem.ContentType, &elem.Name, &elem.Pinned)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		pid, err := openWithKek(pidEnc, kek)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		elem.ID = string(pid)
+		elem.URL = CONFIGURATION.URL + elem.ID
+		resp.Items = append(resp.Items, elem)
+	}
+	apiWrite(w, http.StatusOK, resp)
+}
+
+func apiQueryInt(r *http.Request, name string, def int64) (int64, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	return strconv.ParseInt(v, 10, 64)
+}
+
+func apiDeletePaste(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	uid, _, ok := apiSession(w, r, scopeDelete)
+	if !ok {
+		return
+	}
+	n, err := deleteDataRows(DB, "DELETE FROM data WHERE pid = $1 AND uid = $2 RETURNING fname",
+		pidKey(p.ByName("id")), uid)
+	if err != nil {
+		log.Println(err)
+		apiWriteError(w, http.StatusInternalServerError, "internal", "deleting paste failed")
+		return
+	}
+	if n == 0 {
+		apiWriteError(w, http.StatusNotFound, "not_found", "no such paste")
+		return
+	}
+	apiWrite(w, http.StatusNoContent, nil)
+}
+
+func apiSetExpiry(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	uid, _, ok := apiSession(w, r, scopeExpiry)
+	if !ok {
+		return
+	}
+	var req ApiExpiryRequest
+	if !apiDecode(w, r, 1024, &req) {
+		return
+	}
+	if req.Days < 0 {
+		apiWriteError(w, http.StatusBadRequest, "invalid_request", "days must not be negative")
+		return
+	}
+	var expire any = nil
+	if req.Days > 0 {
+		expire = time.Now().Unix() + req.Days*60*60*24
+	}
+	res, err := DB.Exec("UPDATE data SET expire = $1 WHERE pid = $2 AND uid = $3", expire, pidKey(p.ByName("id")), uid)
+	if err != nil {
+		log.Println(err)
+		apiWriteError(w, http.StatusInternalServerError, "internal", "updating expiry failed")
+		return
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		apiWriteError(w, http.StatusNotFound, "not_found", "no such paste")
+		return
+	}
+	apiWrite(w, http.StatusNoContent, nil)
+}
+
+func apiPin(pinned bool) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		uid, _, ok := apiSession(w, r, scopeExpiry)
+		if !ok {
+			return
+		}
+		ok, err := setPinned(DB, uid, p.ByName("id"), pinned)
+		if err != nil {
+			log.Println(err)
+			apiWriteError(w, http.StatusInternalServerError, "internal", "pinning failed")
+			return
+		}
+		if !ok {
+			apiWriteError(w, http.StatusNotFound, "not_found", "no such paste")
+			return
+		}
+		apiWrite(w, http.StatusNoContent, nil)
+	}
+}
+
+func apiRegister(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	keys := registerKeys(r)
+	if wait := loginLocked(keys...); wait > 0 {
+		apiTooManyRequests(w, wait)
+		return
+	}
+	var req ApiCredentials
+	if !apiDecode(w, r, 1024, &req) {
+		return
+	}
+	loginFailed(keys...)
+	if !validUsername(req.Username) {
+		apiWriteError(w, http.StatusBadRequest, "invalid_request", "invalid username")
+		return
+	}
+	if len(req.Password) < 8 || len(req.Password) > 1024 {
+		apiWriteError(w, http.StatusBadRequest, "invalid_request", "password must be 8-1024 bytes")
+		return
+	}
+	pending, err := registerWithMode(DB, req.Username, req.Password, req.Invite)
+	if errors.Is(err, errRegistrationClosed) || errors.Is(err, errInvalidInvite) {
+		apiWriteError(w, http.StatusForbidden, "registration_forbidden", err.Error())
+		return
+	}
+	if err != nil {
+		apiWriteError(w, http.StatusConflict, "registration_failed", "registration failed")
+		return
+	}
+	if pending {
+		apiWrite(w, http.StatusAccepted, nil)
+		return
+	}
+	apiWrite(w, http.StatusNoContent, nil)
+}
+
+func apiChangePassword(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	uid, _, ok := apiSession(w, r, scopeSession)
+	if !ok {
+		return
+	}
+	var req ApiPasswordChange
+	if !apiDecode(w, r, 4096, &req) {
+		return
+	}
+	err := changePassword(DB, uid, req.Password, req.NewPassword)
+	if err != nil {
+		apiWriteError(w, http.StatusBadRequest, "password_change_failed", "password change failed")
+		return
+	}
+	apiWrite(w, http.StatusNoContent, nil)
+}
+
+func apiTotpSetup(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	uid, kek, ok := apiSession(w, r, scopeSession)
+	if !ok {
+		return
+	}
+	setup, err := setupTotp(DB, uid, kek)
+	if err != nil {
+		apiWriteError(w, http.StatusBadRequest, "totp_setup_failed", err.Error())
+		return
+	}
+	apiWrite(w, http.StatusCreated, ApiTotpSetup{Secret: setup.Secret, URI: setup.URI})
+}
+
+func apiTotpEnable(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	uid, kek, ok := apiSession(w, r, scopeSession)
+	if !ok {
+		return
+	}
+	var req ApiTotpCode
+	if !apiDecode(w, r, 1024, &req) {
+		return
+	}
+	codes, err := enableTotp(DB, uid, kek, req.Code)
+	if err != nil {
+		apiWriteError(w, http.StatusBadRequest, "totp_enable_failed", err.Error())
+		return
+	}
+	apiWrite(w, http.StatusOK, ApiRecoveryCodes{RecoveryCodes: codes})
+}
+
+func apiTotpDisable(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	uid, _, ok := apiSession(w, r, scopeSession)
+	if !ok {
+		return
+	}
+	var req ApiTotpDisable
+	if !apiDecode(w, r, 4096, &req) {
+		return
+	}
+	err := verifyUserSecondFactor(DB, uid, req.Password, req.Code)
+	if err != nil {
+		apiWriteError(w, http.StatusUnauthorized, "unauthorized", "invalid credentials")
+		return
+	}
+	err = disableTotp(DB, uid)
+	if err != nil {
+		log.Println(err)
+		apiWriteError(w, http.StatusInternalServerError, "internal", "disabling totp failed")
+		return
+	}
+	apiWrite(w, http.StatusNoContent, nil)
+}
+
+func apiLogin(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var req ApiCredentials
+	if !apiDecode(w, r, 1024, &req) {
+		return
+	}
+	keys := loginKeys(r, req.Username)
+	if wait := loginLocked(keys...); wait > 0 {
+		apiTooManyRequests(w, wait)
+		return
+	}
+	uid, kek, err := authenticate(DB, req.Username, req.Password)
+	if errors.Is(err, errPendingApproval) {
+		apiWriteError(w, http.StatusForbidden, "pending_approval", "account is pending approval")
+		return
+	}
+	if err != nil {
+		loginFailed(keys...)
+		apiWriteError(w, http.StatusUnauthorized, "unauthorized", "invalid credentials")
+		return
+	}
+	err = checkSecondFactor(DB, uid, kek, req.Totp)
+	if err != nil {
+		zeroByteArray(kek)
+		if errors.Is(err, errTotpRequired) {
+			apiWriteError(w, http.StatusUnauthorized, "totp_required", "totp code required")
+			return
+		}
+		loginFailed(keys...)
+		apiWriteError(w, http.StatusUnauthorized, "unauthorized", "invalid credentials")
+		return
+	}
+	loginSucceeded(keys...)
+	sid, err := createSession(DB, uid, kek, r.UserAgent())
+	if err != nil {
+		log.Println(err)
+		apiWriteError(w, http.StatusInternalServerError, "internal", "creating session failed")
+		return
+	}
+	apiWrite(w, http.StatusCreated, ApiSession{SessionID: sid})
+}
+
+func apiListSessions(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	uid, _, ok := apiSession(w, r, scopeSession)
+	if !ok {
+		return
+	}
+	sessions, err := listSessions(DB, uid, sessionToken(r))
+	if err != nil {
+		log.Println(err)
+		apiWriteError(w, http.StatusInternalServerError, "internal", "listing sessions failed")
+		return
+	}
+	resp := []ApiSessionInfo{}
+	for _, s := range sessions {
+		resp = append(resp, ApiSessionInfo{ID: s.ID, Created: s.Created, LastSeen: s.LastSeen,
+			UserAgent: s.UserAgent, Current: s.Current})
+	}
+	apiWrite(w, http.StatusOK, resp)
+}
+
+func apiRevokeSession(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	uid, _, ok := apiSession(w, r, scopeSession)
+	if !ok {
+		return
+	}
+	if p.ByName("id") == "current" {
+		deleteSession(DB, sessionToken(r))
+		apiWrite(w, http.StatusNoContent, nil)
+		return
+	}
+	id, err := strconv.ParseInt(p.ByName("id"), 10, 64)
+	if err != nil {
+		apiWriteError(w, http.StatusBadRequest, "invalid_request", "invalid session id")
+		return
+	}
+	ok, err = revokeSession(DB, uid, id)
+	if err != nil {
+		log.Println(err)
+		apiWriteError(w, http.StatusInternalServerError, "internal", "revoking session failed")
+		return
+	}
+	if !ok {
+		apiWriteError(w, http.StatusNotFound, "not_found", "no such session")
+		return
+	}
+	apiWrite(w, http.StatusNoContent, nil)
+}
+
+func apiPing(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if _, _, ok := apiSession(w, r, scopeSession); !ok {
+		return
+	}
+	apiWrite(w, http.StatusNoContent, nil)
+}
+
+func apiListTokens(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	uid, _, ok := apiSession(w, r, scopeSession)
+	if !ok {
+		return
+	}
+	tokens, err := listApiTokens(DB, uid)
+	if err != nil {
+		log.Println(err)
+		apiWriteError(w, http.StatusInternalServerError, "internal", "listing tokens failed")
+		return
+	}
+	resp := []ApiTokenInfo{}
+	for _, t := range tokens {
+		resp = append(resp, ApiTokenInfo{ID: t.ID, Name: t.Name, Scopes: t.Scopes, Created: t.Created,
+			Expire: t.Expire, LastUsed: t.LastUsed})
+	}
+	apiWrite(w, http.StatusOK, resp)
+}
+
+func apiCreateToken(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	uid, kek, ok := apiSession(w, r, scopeSession)
+	if !ok {
+		return
+	}
+	var req ApiTokenRequest
+	if !apiDecode(w, r, 4096, &req) {
+		zeroByteArray(kek)
+		return
+	}
+	scopes, err := parseScopes(strings.Join(req.Scopes, ","))
+	if err != nil || req.ExpireDays < 0 {
+		zeroByteArray(kek)
+		apiWriteError(w, http.StatusBadRequest, "invalid_request", "invalid scopes or expiry")
+		return
+	}
+	token, err := createApiToken(DB, uid, kek, req.Name, scopes, req.ExpireDays)
+	if err != nil {
+		apiWriteError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	apiWrite(w, http.StatusCreated, ApiToken{Token: token})
+}
+
+func apiRevokeToken(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	uid, _, ok := apiSession(w, r, scopeSession)
+	if !ok {
+		return
+	}
+	id, err := strconv.ParseInt(p.ByName("id"), 10, 64)
+	if err != nil {
+		apiWriteError(w, http.StatusBadRequest, "invalid_request", "invalid token id")
+		return
+	}
+	ok, err = revokeApiToken(DB, uid, id)
+	if err != nil {
+		log.Println(err)
+		apiWriteError(w, http.StatusInternalServerError, "internal", "revoking token failed")
+		return
+	}
+	if !ok {
+		apiWriteError(w, http.StatusNotFound, "not_found", "no such token")
+		return
+	}
+	apiWrite(w, http.StatusNoContent, nil)
+}
+
+func apiExport(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	uid, kek, ok := apiSession(w, r, scopeSession)
+	if !ok {
+		return
+	}
+	if persistUser(DB, uid) {
+		zeroByteArray(kek)
+		apiWriteError(w, http.StatusForbidden, "forbidden", "not an account")
+		return
+	}
+	defer zeroByteArray(kek)
+	w.Header().Set("content-type", "application/zip")
+	w.Header().Set("content-disposition", `attachment; filename="pastae-export.zip"`)
+	err := exportPastes(DB, uid, kek, w)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func apiDeleteAccount(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	uid, kek, ok := apiSession(w, r, scopeSession)
+	if !ok {
+		return
+	}
+	if persistUser(DB, uid) {
+		zeroByteArray(kek)
+		apiWriteError(w, http.StatusForbidden, "forbidden", "not an account")
+		return
+	}
+	zeroByteArray(kek)
+	var req ApiAccountDeletion
+	if !apiDecode(w, r, 4096, &req) {
+		return
+	}
+	err := confirmAccount(DB, uid, req.Password, req.Totp)
+	if err != nil {
+		apiWriteError(w, http.StatusUnauthorized, "unauthorized", "invalid credentials")
+		return
+	}
+	err = deleteAccount(DB, uid)
+	if err != nil {
+		log.Println(err)
+		apiWriteError(w, http.StatusInternalServerError, "internal", "deleting account failed")
+		return
+	}
+	apiWrite(w, http.StatusNoContent, nil)
+}
+
+func apiAdmin(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	uid, _, ok := apiSession(w, r, scopeSession)
+	if !ok {
+		return 0, false
+	}
+	if !isAdmin(DB, uid) {
+		apiWriteError(w, http.StatusForbidden, "forbidden", "admin only")
+		return 0, false
+	}
+	return uid, true
+}
+
+func apiListInvites(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if _, ok := apiAdmin(w, r); !ok {
+		return
+	}
+	invites, err := listInvites(DB)
+	if err != nil {
+		log.Println(err)
+		apiWriteError(w, http.StatusInternalServerError, "internal", "listing invites failed")
+		return
+	}
+	resp := []ApiInviteInfo{}
+	for _, i := range invites {
+		resp = append(resp, ApiInviteInfo{ID: i.ID, MaxUses: i.MaxUses, Uses: i.Uses, Created: i.Created,
+			Expire: i.Expire})
+	}
+	apiWrite(w, http.StatusOK, resp)
+}
+
+func apiCreateInvite(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	uid, ok := apiAdmin(w, r)
+	if !ok {
+		return
+	}
+	var req ApiInviteRequest
+	if !apiDecode(w, r, 1024, &req) {
+		return
+	}
+	if req.MaxUses == 0 {
+		req.MaxUses = 1
+	}
+	code, err := createInvite(DB, uid, req.MaxUses, req.ExpireDays)
+	if err != nil {
+		apiWriteError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	apiWrite(w, http.StatusCreated, ApiInvite{Code: code})
+}
+
+func apiListPendingUsers(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if _, ok := apiAdmin(w, r); !ok {
+		return
+	}
+	users, err := listPendingUsers(DB)
+	if err != nil {
+		log.Println(err)
+		apiWriteError(w, http.StatusInternalServerError, "internal", "listing users failed")
+		return
+	}
+	resp := []ApiPendingUser{}
+	for _, u := range users {
+		resp = append(resp, ApiPendingUser{ID: u.ID, Username: u.Username})
+	}
+	apiWrite(w, http.StatusOK, resp)
+}
+
+// apiAdminAction returns a handler running action on the id parameter
+func apiAdminAction(action func(*sql.DB, int64) (bool, error)) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if _, ok := apiAdmin(w, r); !ok {
+			return
+		}
+		id, err := strconv.ParseInt(p.ByName("id"), 10, 64)
+		if err != nil {
+			apiWriteError(w, http.StatusBadRequest, "invalid_request", "invalid id")
+			return
+		}
+		ok, err := action(DB, id)
+		if err != nil {
+			log.Println(err)
+			apiWriteError(w, http.StatusInternalServerError, "internal", "internal error")
+			return
+		}
+		if !ok {
+			apiWriteError(w, http.StatusNotFound, "not_found", "not found")
+			return
+		}
+		apiWrite(w, http.StatusNoContent, nil)
+	}
+}
+
+func apiSetQuota(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if _, ok := apiAdmin(w, r); !ok {
+		return
+	}
+	id, err := strconv.ParseInt(p.ByName("id"), 10, 64)
+	if err != nil {
+		apiWriteError(w, http.StatusBadRequest, "invalid_request", "invalid id")
+		return
+	}
+	var req ApiQuota
+	if !apiDecode(w, r, 1024, &req) {
+		return
+	}
+	var maxEntries, maxBytes sql.NullInt64
+	if req.MaxEntries != nil {
+		maxEntries = sql.NullInt64{Int64: *req.MaxEntries, Valid: true}
+	}
+	if req.MaxBytes != nil {
+		maxBytes = sql.NullInt64{Int64: *req.MaxBytes, Valid: true}
+	}
+	ok, err := setUserQuota(DB, id, maxEntries, maxBytes)
+	if err != nil {
+		apiWriteError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	if !ok {
+		apiWriteError(w, http.StatusNotFound, "not_found", "not found")
+		return
+	}
+	apiWrite(w, http.StatusNoContent, nil)
+}
+
+func apiOpenAPI(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	bytes, err := json.Marshal(openAPIDocument(apiRoutes()))
+	if err != nil {
+		log.Println(err)
+		apiWriteError(w, http.StatusInternalServerError, "internal", "internal error")
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	_, err = w.Write(bytes)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// openAPIDocument generates an OpenAPI 3 description from the route table
+func openAPIDocument(routes []ApiRoute) map[string]any {
+	schemas := map[string]any{
+		"ApiError":    openAPISchema(reflect.TypeOf(ApiError{}), nil),
+		"ApiResponse": openAPISchema(reflect.TypeOf(ApiResponse{}), nil),
+	}
+	paths := map[string]any{}
+	for _, route := range routes {
+		op := map[string]any{"summary": route.Summary}
+		if route.Session {
+			op["security"] = []map[string][]string{{"session": {}}}
+		}
+		if route.Scope != "" {
+			op["security"] = []map[string][]string{{"session": {}}, {"token": {}}}
+			op["description"] = "API tokens need the " + route.Scope + " scope."
+		}
+		var params []map[string]any
+		for _, seg := range strings.Split(route.Path, "/") {
+			if strings.HasPrefix(seg, ":") {
+				params = append(params, map[string]any{"name": seg[1:], "in": "path", "required": true,
+					"schema": map[string]string{"type": "string"}})
+			}
+		}
+		if route.Response != nil && reflect.TypeOf(route.Response) == reflect.TypeOf(ApiPasteList{}) {
+			for _, q := range []string{"page", "perPage"} {
+				params = append(params, map[string]any{"name": q, "in": "query",
+					"schema": map[string]string{"type": "integer"}})
+			}
+		}
+		if params != nil {
+			op["parameters"] = params
+		}
+		if route.Request != nil {
+			op["requestBody"] = map[string]any{"required": true, "content": map[string]any{
+				"application/json": map[string]any{"schema": openAPIRef(route.Request, schemas)}}}
+		}
+		success := map[string]any{"description": http.StatusText(route.Status)}
+		if route.Response != nil {
+			success["content"] = map[string]any{"application/json": map[string]any{"schema": map[string]any{
+				"type":       "object",
+				"properties": map[string]any{"data": openAPIRef(route.Response, schemas)},
+			}}}
+		}
+		errorResponse := map[string]any{"description": "Error", "content": map[string]any{
+			"application/json": map[string]any{"schema": map[string]string{"$ref": "#/components/schemas/ApiResponse"}}}}
+		op["responses"] = map[string]any{strconv.Itoa(route.Status): success, "default": errorResponse}
+		p := openAPIPath(route.Path)
+		if _, ok := paths[p]; !ok {
+			paths[p] = map[string]any{}
+		}
+		paths[p].(map[string]any)[strings.ToLower(route.Method)] = op
+	}
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info":    map[string]string{"title": "pastae", "version": "1"},
+		"servers": []map[string]string{{"url": strings.TrimSuffix(CONFIGURATION.URL, "/") + apiPrefix}},
+		"paths":   paths,
+		"components": map[string]any{
+			"schemas": schemas,
+			"securitySchemes": map[string]any{
+				"session": map[string]string{"type": "apiKey", "in": "header", "name": "pastae-sessid"},
+				"token":   map[string]string{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+func openAPIPath(path string) string {
+	segs := strings.Split(path, "/")
+	for i, seg := range segs {
+		if strings.HasPrefix(seg, ":") {
+			segs[i] = "{" + seg[1:] + "}"
+		}
+	}
+	return strings.Join(segs, "/")
+}
+
+func openAPIRef(v any, schemas map[string]any) map[string]any {
+	t := reflect.TypeOf(v)
+	if t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Struct {
+		return map[string]any{"type": "array", "items": openAPIRef(reflect.Zero(t.Elem()).Interface(), schemas)}
+	}
+	if _, ok := schemas[t.Name()]; !ok {
+		schemas[t.Name()] = openAPISchema(t, schemas)
+	}
+	return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+}
+
+func openAPISchema(t reflect.Type, schemas map[string]any) map[string]any {
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Pointer:
+		return openAPISchema(t.Elem(), schemas)
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		if t.Elem().Kind() == reflect.Struct && schemas != nil {
+			return openAPIRef(reflect.Zero(t).Interface(), schemas)
+		}
+		return map[string]any{"type": "array", "items": openAPISchema(t.Elem(), schemas)}
+	case reflect.Struct:
+		props := map[string]any{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := strings.Split(f.Tag.Get("json"), ",")[0]
+			if name == "" || name == "-" {
+				continue
+			}
+			if f.Type.Kind() == reflect.Pointer && f.Type.Elem().Kind() == reflect.Struct {
+				props[name] = map[string]string{"$ref": "#/components/schemas/" + f.Type.Elem().Name()}
+				continue
+			}
+			props[name] = openAPISchema(f.Type, schemas)
+		}
+		return map[string]any{"type": "object", "properties": props}
+	}
+	return map[string]any{}
+}
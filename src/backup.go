@@ -0,0 +1,638 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"modernc.org/sqlite"
+)
+
+// A backup is a tar archive of a snapshot of the SQLite database, the blobs
+// referenced by its pastes and a manifest of their SHA-256 sums. The archive
+// is encrypted in chunks with AES-256-GCM under a key derived from a
+// passphrase with Argon2id, the nonce of a chunk is a random prefix and the
+// chunk number and the last chunk is marked in the additional data, so that
+// reordered or truncated archives are rejected.
+const backupMagic string = "PASTAEBK"
+const backupVersion byte = 1
+const backupChunkSize int = 64 * 1024
+const backupDatabase string = "pastae.db"
+const backupManifest string = "manifest.json"
+const backupBlobs string = "blobs/"
+
+var errBackupCorrupt = errors.New("backup is corrupt or the passphrase is wrong")
+
+// BackupManifest lists the files of a backup with their SHA-256 sums
+type BackupManifest struct {
+	Version int               `json:"version"`
+	Created int64             `json:"created"`
+	Pastes  int               `json:"pastes"`
+	Files   map[string]string `json:"files"`
+}
+
+type backupWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+}
+
+type backupReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+	last    bool
+}
+
+func backupAEAD(passphrase string, salt []byte, argonTime uint32, memory uint32, threads uint8) (cipher.AEAD, error) {
+	key := argon2.IDKey([]byte(passphrase), salt, argonTime, memory, threads, 32)
+	defer zeroByteArray(key)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// newBackupWriter writes the header with the key derivation parameters
+func newBackupWriter(w io.Writer, passphrase string) (*backupWriter, error) {
+	salt, err := generateRandomBytes(16)
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := generateRandomBytes(8)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := backupAEAD(passphrase, salt, ARGONTIME, ARGONMEMORY, ARGONTHREADS)
+	if err != nil {
+		return nil, err
+	}
+	header := append([]byte(backupMagic), backupVersion)
+	header = binary.BigEndian.AppendUint32(header, ARGONTIME)
+	header = binary.BigEndian.AppendUint32(header, ARGONMEMORY)
+	header = append(header, ARGONTHREADS)
+	header = append(header, salt...)
+	header = append(header, prefix...)
+	_, err = w.Write(header)
+	if err != nil {
+		return nil, err
+	}
+	return &backupWriter{w: w, aead: aead, prefix: prefix}, nil
+}
+
+func (b *backupWriter) Write(p []byte) (int, error) {
+	b.buf = append(b.buf, p...)
+	// a full chunk is held back as it may be the last one
+	for len(b.buf) > backupChunkSize {
+		err := b.seal(b.buf[:backupChunkSize], false)
+		if err != nil {
+			return 0, err
+		}
+		b.buf = append(b.buf[:0], b.buf[backupChunkSize:]...)
+	}
+	return len(p), nil
+}
+
+// Close writes the last chunk, which may be empty
+func (b *backupWriter) Close() error {
+	err := b.seal(b.buf, true)
+	zeroByteArray(b.buf)
+	return err
+}
+
+func (b *backupWriter) seal(chunk []byte, last bool) error {
+	if b.counter == ^uint32(0) {
+		return errors.New("backup too large")
+	}
+	nonce := binary.BigEndian.AppendUint32(append([]byte{}, b.prefix...), b.counter)
+	b.counter++
+	_, err := b.w.Write(b.aead.Seal(nil, nonce, chunk, []byte{boolByte(last)}))
+	return err
+}
+
+func boolByte(b bool) byte {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func newBackupReader(r io.Reader, passphrase string) (*backupReader, error) {
+	header := make([]byte, len(backupMagic)+1+4+4+1+16+8)
+	_, err := io.ReadFull(r, header)
+	if err != nil || string(header[:len(backupMagic)]) != backupMagic {
+		return nil, errors.New("not a pastae backup")
+	}
+	h := header[len(backupMagic):]
+	if h[0] != backupVersion {
+		return nil, fmt.Errorf("unsupported backup version %d", h[0])
+	}
+	argonTime := binary.BigEndian.Uint32(h[1:5])
+	memory := binary.BigEndian.Uint32(h[5:9])
+	threads := h[9]
+	if argonTime == 0 || threads == 0 || memory > 4*1024*1024 {
+		return nil, errBackupCorrupt
+	}
+	aead, err := backupAEAD(passphrase, h[10:26], argonTime, memory, threads)
+	if err != nil {
+		return nil, err
+	}
+	return &backupReader{r: bufio.NewReader(r), aead: aead, prefix: h[26:34]}, nil
+}
+
+func (b *backupReader) Read(p []byte) (int, error) {
+	for len(b.buf) == 0 {
+		if b.last {
+			return 0, io.EOF
+		}
+		err := b.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, b.buf)
+	b.buf = b.buf[n:]
+	return n, nil
+}
+
+// open decrypts the next chunk, a chunk is the last one if the archive ends
+// after it
+func (b *backupReader) open() error {
+	chunk := make([]byte, backupChunkSize+b.aead.Overhead())
+	n, err := io.ReadFull(b.r, chunk)
+	if err == io.EOF {
+		return errBackupCorrupt
+	}
+	last := err == io.ErrUnexpectedEOF
+	if err == nil {
+		_, err = b.r.Peek(1)
+		last = err == io.EOF
+		if err == io.EOF {
+			err = nil
+		}
+	} else if last {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	nonce := binary.BigEndian.AppendUint32(append([]byte{}, b.prefix...), b.counter)
+	b.counter++
+	b.buf, err = b.aead.Open(chunk[:0], nonce, chunk[:n], []byte{boolByte(last)})
+	if err != nil {
+		return errBackupCorrupt
+	}
+	b.last = last
+	return nil
+}
+
+// sqliteBackup copies the database to or from file with the SQLite online
+// backup API, which takes a consistent snapshot while other connections and
+// processes keep using the database
+func sqliteBackup(db *sql.DB, file string, restore bool) error {
+	if postgres() {
+		return errors.New("backups need the sqlite database driver, back up PostgreSQL with pg_dump")
+	}
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		ec := conn.Close()
+		if ec != nil {
+			log.Println(ec.Error())
+		}
+	}()
+	return conn.Raw(func(dc any) error {
+		c, ok := dc.(interface {
+			NewBackup(string) (*sqlite.Backup, error)
+			NewRestore(string) (*sqlite.Backup, error)
+		})
+		if !ok {
+			return errors.New("database driver has no backup API")
+		}
+		var b *sqlite.Backup
+		var err error
+		if restore {
+			b, err = c.NewRestore(file)
+		} else {
+			b, err = c.NewBackup(file)
+		}
+		if err != nil {
+			return err
+		}
+		// the copy fails while another connection writes, retry for a while
+		for attempt := 0; attempt < 50; attempt++ {
+			_, err = b.Step(-1)
+			if err == nil {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		ec := b.Finish()
+		if err == nil {
+			err = ec
+		}
+		return err
+	})
+}
+
+// addBackupFile adds a file to the archive and its sum to the manifest
+func addBackupFile(tw *tar.Writer, manifest *BackupManifest, name string, r io.Reader, size int64) error {
+	err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: size, ModTime: time.Unix(manifest.Created, 0),
+		Typeflag: tar.TypeReg})
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tw, h), r)
+	if err != nil {
+		return err
+	}
+	manifest.Files[name] = hex.EncodeToString(h.Sum(nil))
+	return nil
+}
+
+// backupStore writes a backup of the database and the blobs its pastes
+// reference to w and returns the number of pastes. Pastes deleted while the
+// backup runs are left out.
+func backupStore(db *sql.DB, w io.Writer, passphrase string) (int, error) {
+	dir, err := os.MkdirTemp("", "pastae-backup")
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		ec := os.RemoveAll(dir)
+		if ec != nil {
+			log.Println(ec.Error())
+		}
+	}()
+	snapshotFile := filepath.Join(dir, backupDatabase)
+	err = sqliteBackup(db, snapshotFile, false)
+	if err != nil {
+		return 0, err
+	}
+	bw, err := newBackupWriter(w, passphrase)
+	if err != nil {
+		return 0, err
+	}
+	tw := tar.NewWriter(bw)
+	manifest := BackupManifest{Version: 1, Created: time.Now().Unix(), Files: make(map[string]string)}
+	pastes, err := backupBlobFiles(tw, &manifest, snapshotFile)
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.Open(snapshotFile)
+	if err != nil {
+		return 0, err
+	}
+	fi, err := f.Stat()
+	if err == nil {
+		err = addBackupFile(tw, &manifest, backupDatabase, f, fi.Size())
+	}
+	ec := f.Close()
+	if err == nil {
+		err = ec
+	}
+	if err != nil {
+		return 0, err
+	}
+	manifest.Pastes = pastes
+	m, err := json.Marshal(manifest)
+	if err != nil {
+		return 0, err
+	}
+	err = addBackupFile(tw, &manifest, backupManifest, bytes.NewReader(m), int64(len(m)))
+	if err != nil {
+		return 0, err
+	}
+	err = tw.Close()
+	if err != nil {
+		return 0, err
+	}
+	return pastes, bw.Close()
+}
+
+// backupBlobFiles adds the blobs referenced by the snapshot to the archive
+// and deletes the rows of pastes whose blob is gone from the snapshot
+func backupBlobFiles(tw *tar.Writer, manifest *BackupManifest, snapshotFile string) (int, error) {
+	snapshot, err := sql.Open("sqlite", snapshotFile)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		ec := snapshot.Close()
+		if ec != nil {
+			log.Println(ec.Error())
+		}
+	}()
+	var fnames []string
+	res, err := snapshot.Query("SELECT fname FROM data")
+	if err != nil {
+		return 0, err
+	}
+	for res.Next() {
+		var fname string
+		err = res.Scan(&fname)
+		if err != nil {
+			ec := res.Close()
+			if ec != nil {
+				log.Println(ec.Error())
+			}
+			return 0, err
+		}
+		fnames = append(fnames, fname)
+	}
+	err = res.Close()
+	if err != nil {
+		return 0, err
+	}
+	pastes := 0
+	for _, fname := range fnames {
+		data, err := readDataFile(fname)
+		if err != nil {
+			log.Println("leaving out paste deleted during backup:", err)
+			_, err = snapshot.Exec("DELETE FROM data WHERE fname = $1", fname)
+			if err != nil {
+				return 0, err
+			}
+			continue
+		}
+		err = addBackupFile(tw, manifest, backupBlobs+fname, bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return 0, err
+		}
+		pastes++
+	}
+	return pastes, nil
+}
+
+// restoreStore checks a backup completely before it replaces the database
+// and stores its blobs, and returns the number of restored pastes. Blobs of
+// pastes not in the backup are left for -fsck-repair.
+func restoreStore(db *sql.DB, r io.Reader, passphrase string) (int, error) {
+	if postgres() {
+		return 0, errors.New("backups need the sqlite database driver, restore PostgreSQL with pg_restore")
+	}
+	dir, err := os.MkdirTemp("", "pastae-restore")
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		ec := os.RemoveAll(dir)
+		if ec != nil {
+			log.Println(ec.Error())
+		}
+	}()
+	sums, manifest, err := extractBackup(r, passphrase, dir)
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := sums[backupDatabase]; !ok || len(sums) != len(manifest.Files) {
+		return 0, errors.New("backup files do not match the manifest")
+	}
+	for name, sum := range manifest.Files {
+		if sums[name] != sum {
+			return 0, errors.New("checksum mismatch of " + name)
+		}
+	}
+	snapshotFile := filepath.Join(dir, backupDatabase)
+	fnames, err := checkBackupDatabase(snapshotFile)
+	if err != nil {
+		return 0, err
+	}
+	for _, fname := range fnames {
+		if _, ok := sums[backupBlobs+fname]; !ok {
+			return 0, errors.New("backup misses the blob of a paste")
+		}
+	}
+	for name := range sums {
+		fname, ok := strings.CutPrefix(name, backupBlobs)
+		if !ok {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return 0, err
+		}
+		err = writeDataFile(fname, data)
+		if err != nil {
+			return 0, err
+		}
+	}
+	err = sqliteBackup(db, snapshotFile, true)
+	if err != nil {
+		return 0, err
+	}
+	err = createDBTablesAndIndexes(db)
+	if err != nil {
+		return 0, err
+	}
+	return len(fnames), nil
+}
+
+// extractBackup decrypts a backup into dir and returns the sums of its files
+func extractBackup(r io.Reader, passphrase string, dir string) (map[string]string, BackupManifest, error) {
+	var manifest BackupManifest
+	br, err := newBackupReader(r, passphrase)
+	if err != nil {
+		return nil, manifest, err
+	}
+	err = os.Mkdir(filepath.Join(dir, backupBlobs), 0700)
+	if err != nil {
+		return nil, manifest, err
+	}
+	sums := make(map[string]string)
+	tr := tar.NewReader(br)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, manifest, err
+		}
+		name := header.Name
+		if name == backupManifest {
+			err = json.NewDecoder(tr).Decode(&manifest)
+			if err != nil {
+				return nil, manifest, err
+			}
+			continue
+		}
+		fname, blob := strings.CutPrefix(name, backupBlobs)
+		if header.Typeflag != tar.TypeReg || (name != backupDatabase && !(blob && isDataFileName(fname))) {
+			return nil, manifest, errors.New("unexpected file in backup " + name)
+		}
+		if _, ok := sums[name]; ok {
+			return nil, manifest, errors.New("duplicate file in backup " + name)
+		}
+		f, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return nil, manifest, err
+		}
+		h := sha256.New()
+		_, err = io.Copy(io.MultiWriter(f, h), tr)
+		ec := f.Close()
+		if err == nil {
+			err = ec
+		}
+		if err != nil {
+			return nil, manifest, err
+		}
+		sums[name] = hex.EncodeToString(h.Sum(nil))
+	}
+	if manifest.Version != 1 || manifest.Files == nil {
+		return nil, manifest, errors.New("backup has no manifest")
+	}
+	return sums, manifest, nil
+}
+
+// checkBackupDatabase runs the SQLite integrity check on a restored database
+// and returns the blobs referenced by its pastes
+func checkBackupDatabase(file string) ([]string, error) {
+	snapshot, err := sql.Open("sqlite", file)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		ec := snapshot.Close()
+		if ec != nil {
+			log.Println(ec.Error())
+		}
+	}()
+	var result string
+	err = snapshot.QueryRow("PRAGMA integrity_check").Scan(&result)
+	if err != nil {
+		return nil, err
+	}
+	if result != "ok" {
+		return nil, errors.New("backup database integrity check failed: " + result)
+	}
+	version, err := schemaVersion(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	all, err := migrations()
+	if err != nil {
+		return nil, err
+	}
+	if version > all[len(all)-1].Version {
+		return nil, fmt.Errorf("backup has schema version %d, newer than this pastae", version)
+	}
+	res, err := snapshot.Query("SELECT fname FROM data")
+	if err != nil {
+		return nil, err
+	}
+	var fnames []string
+	for res.Next() {
+		var fname string
+		err = res.Scan(&fname)
+		if err != nil {
+			ec := res.Close()
+			if ec != nil {
+				log.Println(ec.Error())
+			}
+			return nil, err
+		}
+		fnames = append(fnames, fname)
+	}
+	return fnames, res.Close()
+}
+
+// backupCommand runs the backup FILE or restore FILE subcommand of the server
+// with the passphrase in PASTAE_BACKUP_PASSPHRASE. They are not part of the
+// cmd/pastae client as they need the database and data files of the server.
+func backupCommand(command string, file string) error {
+	if !CONFIGURATION.Database {
+		return errors.New("database is not enabled")
+	}
+	if file == "" {
+		return errors.New("usage: pastae " + command + " FILE")
+	}
+	passphrase := os.Getenv("PASTAE_BACKUP_PASSPHRASE")
+	if passphrase == "" {
+		return errors.New("PASTAE_BACKUP_PASSPHRASE is not set")
+	}
+	var err error
+	BLOBS, err = openBlobStore()
+	if err != nil {
+		return err
+	}
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		ec := db.Close()
+		if ec != nil {
+			log.Println(ec.Error())
+		}
+	}()
+	if command == "restore" {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			ec := f.Close()
+			if ec != nil {
+				log.Println(ec.Error())
+			}
+		}()
+		pastes, err := restoreStore(db, f, passphrase)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("restored %d pastes from %s\n", pastes, file)
+		return nil
+	}
+	// written to a temporary file so that a failed backup leaves nothing
+	tmp := file + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	pastes, err := backupStore(db, f, passphrase)
+	if err == nil {
+		err = f.Sync()
+	}
+	ec := f.Close()
+	if err == nil {
+		err = ec
+	}
+	if err == nil {
+		err = os.Rename(tmp, file)
+	}
+	if err != nil {
+		ec = os.Remove(tmp)
+		if ec != nil {
+			log.Println(ec.Error())
+		}
+		return err
+	}
+	fmt.Printf("backed up %d pastes to %s\n", pastes, file)
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"time"
+)
+
+// BlobStore holds the encrypted pastes referenced by data.fname
+type BlobStore interface {
+	Put(name string, data []byte) error
+	Get(name string) ([]byte, error)
+	Delete(name string) error
+	List() ([]BlobInfo, error)
+	Size(name string) (int64, error)
+}
+
+// BlobInfo is a stored blob and its modification time
+type BlobInfo struct {
+	Name     string
+	Modified time.Time
+}
+
+// Blob stores, an empty store is the file store in DataPath
+const blobStoreFile string = "file"
+const blobStoreS3 string = "s3"
+
+var BLOBS BlobStore = FileStore{}
+
+func openBlobStore() (BlobStore, error) {
+	switch CONFIGURATION.BlobStore {
+	case "", blobStoreFile:
+		if _, err := os.Stat(CONFIGURATION.DataPath); os.IsNotExist(err) {
+			return nil, errors.New("DataPath (" + CONFIGURATION.DataPath + ") does not exist")
+		}
+		return FileStore{}, nil
+	case blobStoreS3:
+		s, err := newS3Store()
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	return nil, errors.New("unknown blob store " + CONFIGURATION.BlobStore)
+}
+
+// FileStore keeps blobs as files in DataPath
+type FileStore struct{}
+
+// Put writes a file atomically. The data is synced to a temporary file which
+// is then renamed, so a crash leaves either no file or the complete file and
+// at most a temporary file removed by fsckDataPath.
+func (FileStore) Put(name string, data []byte) error {
+	tmp := CONFIGURATION.DataPath + name + dataFileTmpSuffix
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	ec := f.Close()
+	if err == nil {
+		err = ec
+	}
+	if err == nil {
+		err = os.Rename(tmp, CONFIGURATION.DataPath+name)
+	}
+	if err != nil {
+		ec = os.Remove(tmp)
+		if ec != nil {
+			log.Println(ec)
+		}
+		return err
+	}
+	return syncDataPath()
+}
+
+func (FileStore) Get(name string) ([]byte, error) {
+	return os.ReadFile(CONFIGURATION.DataPath + name)
+}
+
+func (FileStore) Delete(name string) error {
+	return os.Remove(CONFIGURATION.DataPath + name)
+}
+
+func (FileStore) Size(name string) (int64, error) {
+	info, err := os.Stat(CONFIGURATION.DataPath + name)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// List returns the regular files in DataPath
+func (FileStore) List() ([]BlobInfo, error) {
+	entries, err := os.ReadDir(CONFIGURATION.DataPath)
+	if err != nil {
+		return nil, err
+	}
+	var blobs []BlobInfo
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		info, err := e.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, BlobInfo{Name: e.Name(), Modified: info.ModTime()})
+	}
+	return blobs, nil
+}
+
+// syncDataPath makes renames and removals in DataPath durable
+func syncDataPath() error {
+	d, err := os.Open(CONFIGURATION.DataPath)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	ec := d.Close()
+	if err != nil {
+		return err
+	}
+	return ec
+}
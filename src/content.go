@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// Content types accepted for file uploads when contentTypes is not
+// configured. Plain text is always accepted.
+var defaultContentTypes = []string{
+	"image/jpeg", "image/tiff", "image/webp", "image/gif", "image/png", "image/avif",
+	"application/pdf",
+	"video/mp4", "video/webm", "application/ogg", "audio/ogg", "audio/mpeg",
+	"application/zip", "application/x-gzip", "application/x-tar", "application/x-bzip2", "application/x-xz",
+	"application/x-7z-compressed", "application/zstd", "application/x-rar-compressed",
+	"application/json",
+	"application/octet-stream",
+}
+
+// Magic numbers of types http.DetectContentType does not know
+var contentMagic = []struct {
+	Offset      int
+	Magic       string
+	ContentType string
+}{
+	{0, "7z\xbc\xaf\x27\x1c", "application/x-7z-compressed"},
+	{0, "\xfd7zXZ\x00", "application/x-xz"},
+	{0, "BZh", "application/x-bzip2"},
+	{0, "\x28\xb5\x2f\xfd", "application/zstd"},
+	{257, "ustar", "application/x-tar"},
+	{0, "\xff\xfb", "audio/mpeg"},
+	{0, "\xff\xf3", "audio/mpeg"},
+	{0, "\xff\xf2", "audio/mpeg"},
+}
+
+// Content types implied by file name extensions. A file whose content does
+// not match its extension is stored as application/octet-stream.
+var extensionContentTypes = map[string]string{
+	".jpg": "image/jpeg", ".jpeg": "image/jpeg", ".tif": "image/tiff", ".tiff": "image/tiff",
+	".webp": "image/webp", ".gif": "image/gif", ".png": "image/png", ".avif": "image/avif",
+	".pdf": "application/pdf", ".mp4": "video/mp4", ".m4a": "video/mp4", ".webm": "video/webm",
+	".ogg": "application/ogg", ".oga": "application/ogg", ".ogv": "application/ogg", ".mp3": "audio/mpeg",
+	".zip": "application/zip", ".gz": "application/x-gzip", ".tgz": "application/x-gzip",
+	".tar": "application/x-tar", ".bz2": "application/x-bzip2", ".xz": "application/x-xz",
+	".7z": "application/x-7z-compressed", ".zst": "application/zstd", ".rar": "application/x-rar-compressed",
+	".json": "application/json",
+}
+
+// Paste ID extensions of content types whose subtype is not a usual extension
+var contentTypeExtensions = map[string]string{
+	"text/plain": "txt", "audio/mpeg": "mp3", "application/ogg": "ogg",
+	"application/x-gzip": "gz", "application/x-tar": "tar", "application/x-bzip2": "bz2",
+	"application/x-xz": "xz", "application/x-7z-compressed": "7z", "application/zstd": "zst",
+	"application/x-rar-compressed": "rar", "application/octet-stream": "bin", "image/svg+xml": "svg",
+}
+
+// contentTypeExtension returns the paste ID extension for a content type
+func contentTypeExtension(ct string) string {
+	base := baseContentType(ct)
+	if ext, ok := contentTypeExtensions[base]; ok {
+		return ext
+	}
+	_, sub, ok := strings.Cut(base, "/")
+	if !ok {
+		return ""
+	}
+	return sub
+}
+
+// baseContentType strips the parameters of a content type
+func baseContentType(ct string) string {
+	base, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		base, _, _ = strings.Cut(ct, ";")
+		return strings.ToLower(strings.TrimSpace(base))
+	}
+	return base
+}
+
+// detectContentType sniffs data with http.DetectContentType and the magic
+// numbers it lacks, recognises JSON among text and checks the result against
+// the extension of name
+func detectContentType(data []byte, name string) string {
+	ct := baseContentType(http.DetectContentType(data))
+	if ct == "application/octet-stream" {
+		for _, m := range contentMagic {
+			if len(data) >= m.Offset+len(m.Magic) && string(data[m.Offset:m.Offset+len(m.Magic)]) == m.Magic {
+				ct = m.ContentType
+				break
+			}
+		}
+	}
+	if ct == "text/plain" {
+		trimmed := bytes.TrimSpace(data)
+		if len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') && json.Valid(trimmed) {
+			ct = "application/json"
+		} else {
+			ct = "text/plain;charset=utf-8"
+		}
+	}
+	ext := strings.ToLower(filepath.Ext(name))
+	if expected, ok := extensionContentTypes[ext]; ok && expected != baseContentType(ct) {
+		return "application/octet-stream"
+	}
+	return ct
+}
+
+// validContentType returns the content type of an uploaded file and whether
+// it is in the contentTypes allow-list
+func validContentType(data []byte, name string) (bool, string) {
+	ct := detectContentType(data, name)
+	return allowedContentType(ct), ct
+}
+
+// allowedContentType reports whether ct is plain text or in contentTypes
+func allowedContentType(ct string) bool {
+	base := baseContentType(ct)
+	if base == "text/plain" {
+		return true
+	}
+	allowed := CONFIGURATION.ContentTypes
+	if len(allowed) == 0 {
+		allowed = defaultContentTypes
+	}
+	for _, a := range allowed {
+		if strings.EqualFold(a, base) {
+			return true
+		}
+	}
+	return false
+}
+
+// declaredContentType checks a content type declared by the uploader. Plain
+// text and application/octet-stream may be declared for any data, other
+// types only if the data sniffs as that type. An empty declaration uses the
+// sniffed type.
+func declaredContentType(data []byte, name string, declared string) (bool, string) {
+	base := baseContentType(declared)
+	if base == "text/plain" {
+		return true, "text/plain;charset=utf-8"
+	}
+	valid, ct := validContentType(data, name)
+	if declared == "" || base == baseContentType(ct) {
+		return valid, ct
+	}
+	if base == "application/octet-stream" {
+		return allowedContentType(base), base
+	}
+	return false, ct
+}
+
+// Paste responses are sandboxed so that a payload the browser renders
+// anyway can neither run script nor load anything on the pastae origin
+const pasteCSP = "default-src 'none'; img-src 'self'; media-src 'self'; style-src 'unsafe-inline'; " +
+	"frame-ancestors 'none'; sandbox"
+
+// inlineContentType reports whether a paste may be shown in the browser.
+// Everything but plain text, JSON and non-SVG images, audio and video is
+// forced to download. PDF is downloaded too, as viewers refuse to run in the
+// sandbox.
+func inlineContentType(ct string) bool {
+	base := baseContentType(ct)
+	switch {
+	case base == "image/svg+xml":
+		return false
+	case strings.HasPrefix(base, "image/"), strings.HasPrefix(base, "audio/"), strings.HasPrefix(base, "video/"):
+		return true
+	}
+	return base == "text/plain" || base == "application/json" || base == "application/ogg"
+}
+
+// setPasteHeaders sets the content type, disposition with the original file
+// name, and the security and cache headers of a paste response. Burn after
+// reading pastes must never be stored by a cache.
+func setPasteHeaders(w http.ResponseWriter, id string, name string, ct string, burn bool) {
+	h := w.Header()
+	h.Set("content-type", ct)
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Content-Security-Policy", pasteCSP)
+	h.Set("Referrer-Policy", "no-referrer")
+	disposition := "attachment"
+	if inlineContentType(ct) {
+		disposition = "inline"
+	}
+	if name == "" {
+		name = id
+	}
+	cd := mime.FormatMediaType(disposition, map[string]string{"filename": filepath.Base(name)})
+	if cd == "" {
+		cd = disposition
+	}
+	h.Set("Content-Disposition", cd)
+	if burn {
+		h.Set("Cache-Control", "no-store")
+		h.Set("Pragma", "no-cache")
+	} else {
+		h.Set("Cache-Control", "private, no-cache")
+	}
+}
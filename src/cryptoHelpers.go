@@ -4,10 +4,24 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
 )
 
+// Argon2id parameters for new password hashes, stored hashes carry their own
+var ARGONTIME uint32 = 3
+var ARGONMEMORY uint32 = 64 * 1024
+var ARGONTHREADS uint8 = 2
+
 func encrypt(data []byte, key []byte, nonce []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
@@ -66,3 +80,107 @@ func zeroByteArray(arr []byte) {
 		arr[i] = 0
 	}
 }
+
+// tokenHash is the form in which secret tokens are stored in the database
+func tokenHash(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
+
+// tokenKey derives a 128 bit key from a secret token for wrapping data
+// that only the token holder may unwrap
+func tokenKey(token string) []byte {
+	sum := sha512.Sum512([]byte("pastae-token-key" + token))
+	key := make([]byte, 16)
+	copy(key, sum[0:16])
+	zeroByteArray(sum[:])
+	return key
+}
+
+// hashPassword returns an Argon2id hash of password with a random salt in the
+// $argon2id$v=19$m=...,t=...,p=...$salt$hash format
+func hashPassword(password string) (string, error) {
+	salt, err := generateRandomBytes(16)
+	if err != nil {
+		return "", err
+	}
+	hash := argon2.IDKey([]byte(password), salt, ARGONTIME, ARGONMEMORY, ARGONTHREADS, 32)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, ARGONMEMORY, ARGONTIME, ARGONTHREADS,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(hash)), nil
+}
+
+func verifyPassword(password string, encoded string) (bool, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" || parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return false, errors.New("invalid password hash")
+	}
+	var memory, time uint32
+	var threads uint8
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads)
+	if err != nil {
+		return false, err
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, err
+	}
+	hash, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, err
+	}
+	other := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(hash)))
+	return subtle.ConstantTimeCompare(hash, other) == 1, nil
+}
+
+// pidKey is the form in which paste IDs are stored in the database. The paste
+// ID itself is the secret from which the paste encryption key is derived.
+func pidKey(id string) string {
+	return hex.EncodeToString(tokenHash(id))
+}
+
+// sealWithKek encrypts data with a random key scrambled with kek and returns
+// key, nonce and ciphertext as one slice
+func sealWithKek(data []byte, kek []byte) ([]byte, error) {
+	key, err := generateRandomBytes(16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := generateRandomBytes(12)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := encryptData(data, key, nonce, kek)
+	if err != nil {
+		return nil, err
+	}
+	return append(append(key, nonce...), sealed...), nil
+}
+
+func openWithKek(sealed []byte, kek []byte) ([]byte, error) {
+	if len(sealed) < 28 {
+		return nil, errors.New("sealed data too short")
+	}
+	sum := kdf(sealed[0:16], kek)
+	data, err := decrypt(sealed[28:], sum[0:16], sealed[16:28])
+	zeroByteArray(sum)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// kekWrapKey derives the key wrapping a user KEK from the user's password,
+// using the Argon2id parameters of the user's password hash
+func kekWrapKey(password string, salt []byte, encoded string) ([]byte, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return nil, errors.New("invalid password hash")
+	}
+	var memory, time uint32
+	var threads uint8
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads)
+	if err != nil {
+		return nil, err
+	}
+	return argon2.IDKey([]byte(password), salt, time, memory, threads, 16), nil
+}
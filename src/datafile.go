@@ -0,0 +1,149 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"log"
+	"strings"
+	"time"
+)
+
+// Data files are named with 24 hex digits and written to a .tmp file first
+const dataFileNameLength int = 24
+const dataFileTmpSuffix string = ".tmp"
+
+// Blobs modified within fsckGracePeriod may belong to an upload whose row is
+// not committed yet, on this or another instance, and are left alone
+const fsckGracePeriod time.Duration = time.Hour
+
+// FsckReport lists inconsistencies between the data table and blob store
+type FsckReport struct {
+	OrphanFiles  []string
+	MissingFiles []string
+	TempFiles    []string
+}
+
+// writeDataFile stores an encrypted paste in the blob store
+func writeDataFile(fname string, data []byte) error {
+	return BLOBS.Put(fname, data)
+}
+
+func readDataFile(fname string) ([]byte, error) {
+	return BLOBS.Get(fname)
+}
+
+func removeDataFile(fname string) {
+	if fname == "" {
+		log.Println("empty file name")
+		return
+	}
+	err := BLOBS.Delete(fname)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// deleteDataRows runs a DELETE ... RETURNING fname query and removes the data
+// files of the deleted rows once the delete is committed. A crash in between
+// leaves orphan files, never rows without files.
+func deleteDataRows(db *sql.DB, query string, args ...any) (int64, error) {
+	res, err := db.Query(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	var fnames []string
+	for res.Next() {
+		var fname string
+		err = res.Scan(&fname)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		fnames = append(fnames, fname)
+	}
+	err = res.Err()
+	ec := res.Close()
+	if err == nil {
+		err = ec
+	}
+	if err != nil {
+		return 0, err
+	}
+	SESSIONPASTECOUNT.Add(-int64(len(fnames)))
+	for _, fname := range fnames {
+		removeDataFile(fname)
+	}
+	return int64(len(fnames)), nil
+}
+
+func isDataFileName(name string) bool {
+	if len(name) != dataFileNameLength || strings.ToLower(name) != name {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
+
+// fsckDataPath reconciles data.fname against the blob store. With
+// repair, orphan and temporary files older than fsckGracePeriod are removed.
+// Rows whose file is missing are only reported, as an unmounted DataPath or a
+// wrong bucket looks the same. Other files in the blob store are left alone.
+func fsckDataPath(db *sql.DB, repair bool) (FsckReport, error) {
+	var report FsckReport
+	blobs, err := BLOBS.List()
+	if err != nil {
+		return report, err
+	}
+	limit := time.Now().Add(-fsckGracePeriod)
+	files := make(map[string]bool)
+	for _, blob := range blobs {
+		name := blob.Name
+		recent := blob.Modified.After(limit)
+		if isDataFileName(strings.TrimSuffix(name, dataFileTmpSuffix)) && strings.HasSuffix(name, dataFileTmpSuffix) {
+			if !recent {
+				report.TempFiles = append(report.TempFiles, name)
+			}
+		} else if isDataFileName(name) {
+			files[name] = recent
+		}
+	}
+	res, err := db.Query("SELECT fname FROM data")
+	if err != nil {
+		return report, err
+	}
+	for res.Next() {
+		var fname string
+		err = res.Scan(&fname)
+		if err != nil {
+			ec := res.Close()
+			if ec != nil {
+				log.Println(ec.Error())
+			}
+			return report, err
+		}
+		if _, ok := files[fname]; ok {
+			delete(files, fname)
+		} else {
+			report.MissingFiles = append(report.MissingFiles, fname)
+		}
+	}
+	err = res.Close()
+	if err != nil {
+		return report, err
+	}
+	for fname, recent := range files {
+		if !recent {
+			report.OrphanFiles = append(report.OrphanFiles, fname)
+		}
+	}
+	if !repair {
+		return report, nil
+	}
+	for _, fname := range report.OrphanFiles {
+		removeDataFile(fname)
+	}
+	for _, name := range report.TempFiles {
+		removeDataFile(name)
+	}
+	return report, nil
+}
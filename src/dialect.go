@@ -0,0 +1,98 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+// Metadata database drivers, an empty driver is SQLite. Queries use $n
+// placeholders and RETURNING, which both drivers support, the differences
+// are kept to this file.
+const driverSQLite string = "sqlite"
+const driverPostgres string = "postgres"
+
+func postgres() bool {
+	return CONFIGURATION.DatabaseDriver == driverPostgres
+}
+
+// openDatabase opens DatabaseFile with SQLite or DatabaseURL with PostgreSQL
+func openDatabase() (*sql.DB, error) {
+	switch CONFIGURATION.DatabaseDriver {
+	case "", driverSQLite:
+		return sql.Open("sqlite", CONFIGURATION.DatabaseFile)
+	case driverPostgres:
+		return sql.Open("postgres", CONFIGURATION.DatabaseURL)
+	}
+	return nil, errors.New("unknown database driver " + CONFIGURATION.DatabaseDriver)
+}
+
+var postgresTypes = strings.NewReplacer(
+	"INTEGER PRIMARY KEY", "BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY",
+	"INTEGER", "BIGINT",
+	"BLOB", "BYTEA")
+
+// ddl translates the SQLite column types of a schema statement for
+// PostgreSQL, where INTEGER is 32 bits
+func ddl(stmt string) string {
+	if postgres() {
+		return postgresTypes.Replace(stmt)
+	}
+	return stmt
+}
+
+func tableExists(db *sql.DB, table string) (bool, error) {
+	query := "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = $1"
+	if postgres() {
+		query = "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() " +
+			"AND table_name = $1"
+	}
+	var count int
+	err := db.QueryRow(query, table).Scan(&count)
+	return count > 0, err
+}
+
+func columnExists(tx *sql.Tx, table string, column string) (bool, error) {
+	query := "SELECT COUNT(*) FROM pragma_table_info($1) WHERE name = $2"
+	if postgres() {
+		query = "SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = current_schema() " +
+			"AND table_name = $1 AND column_name = $2"
+	}
+	var count int
+	err := tx.QueryRow(query, table, column).Scan(&count)
+	return count > 0, err
+}
+
+// zeroBlob returns an expression of as many zero bytes as column has
+func zeroBlob(column string) string {
+	if postgres() {
+		return "decode(repeat('00', length(" + column + ")), 'hex')"
+	}
+	return "zeroblob(length(" + column + "))"
+}
+
+// boolInt passes a flag to the INTEGER columns used for flags
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// queryRower is a *sql.DB or a *sql.Tx
+type queryRower interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// lockTable serialises writers of table across instances until tx ends.
+// SQLite allows a single writer and needs no lock.
+func lockTable(tx *sql.Tx, table string) error {
+	if !postgres() {
+		return nil
+	}
+	_, err := tx.Exec("LOCK TABLE " + table + " IN SHARE ROW EXCLUSIVE MODE")
+	return err
+}
@@ -1,10 +1,10 @@
 package main
 
 import (
+	"database/sql"
 	"errors"
 	"log"
 	"net/http"
-	"os"
 
 	"github.com/julienschmidt/httprouter"
 )
@@ -21,17 +21,10 @@ func servePaste(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		}
 	}()
 
-	PASTAEMUTEX.RLock()
-	data, ok := PASTAEMAP[p.ByName("id")]
-	PASTAEMUTEX.RUnlock()
+	data, resp, ok := ephemeralPaste(p.ByName("id"))
 	if ok {
-		resp, err := fetchPaste(data)
-		if err != nil {
-			http.NotFound(w, r)
-			return
-		}
-		w.Header().Set("content-type", data.ContentType)
-		_, err = w.Write(resp)
+		setPasteHeaders(w, data.ID, data.Name, data.ContentType, data.BurnAfterReading)
+		_, err := w.Write(resp)
 		if err != nil {
 			log.Println(err.Error())
 		}
@@ -53,17 +46,10 @@ func servePasteS(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		}
 	}()
 	id := p.ByName("id")
-	PASTAEMUTEX.RLock()
-	data, ok := PASTAEMAP[id]
-	PASTAEMUTEX.RUnlock()
+	data, resp, ok := ephemeralPaste(id)
 	if ok {
-		resp, err := fetchPaste(data)
-		if err != nil {
-			http.NotFound(w, r)
-			return
-		}
-		w.Header().Set("content-type", data.ContentType)
-		_, err = w.Write(resp)
+		setPasteHeaders(w, data.ID, data.Name, data.ContentType, data.BurnAfterReading)
+		_, err := w.Write(resp)
 		if err != nil {
 			log.Println(err.Error())
 		}
@@ -72,31 +58,22 @@ func servePasteS(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		var fname string
 		var key []byte
 		var nonce []byte
-		var uid int64
 		var contentType string
-		var ukek []byte
-		const qs string = "SELECT fname,key,nonce,uid,ct,kek FROM data,users WHERE pid=$1 AND users.id=data.uid"
-		err := DB.QueryRow(qs, id).Scan(&fname, &key, &nonce, &uid, &contentType, &ukek)
-		if err != nil {
-			log.Println(err)
-			http.NotFound(w, r)
-			return
-		}
-		file, err := os.ReadFile(CONFIGURATION.DataPath + fname)
+		var name string
+		const qs string = "SELECT fname,key,nonce,ct,COALESCE(name, '') FROM data WHERE pid=$1"
+		err := DB.QueryRow(qs, pidKey(id)).Scan(&fname, &key, &nonce, &contentType, &name)
 		if err != nil {
 			log.Println(err)
 			http.NotFound(w, r)
 			return
 		}
-		sum := kdf(key, ukek)
-		file, err = decrypt(file, sum[0:16], nonce)
-		zeroByteArray(sum)
+		file, err := readPasteFile(fname, key, nonce, id)
 		if err != nil {
 			log.Println(err)
 			http.NotFound(w, r)
 			return
 		}
-		w.Header().Set("content-type", contentType)
+		setPasteHeaders(w, id, name, contentType, false)
 		_, err = w.Write(file)
 		if err != nil {
 			log.Println(err.Error())
@@ -105,20 +82,64 @@ func servePasteS(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	}
 }
 
+// ephemeralPaste returns an anonymous paste with its content, a burn after
+// reading paste is removed
+func ephemeralPaste(id string) (*Pastae, []byte, bool) {
+	if sharedState() {
+		paste, resp, err := takeSharedPaste(id)
+		if err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				log.Println(err)
+			}
+			return nil, nil, false
+		}
+		return paste, resp, true
+	}
+	PASTAEMUTEX.RLock()
+	paste, ok := PASTAEMAP[id]
+	PASTAEMUTEX.RUnlock()
+	if !ok {
+		return nil, nil, false
+	}
+	resp, err := fetchPaste(paste)
+	if err != nil {
+		return nil, nil, false
+	}
+	return paste, resp, true
+}
+
+// fetchPaste decrypts an in-memory paste. A burn after reading paste is
+// removed and claimed on the peers first, so concurrent readers get it at
+// most once.
 func fetchPaste(pasta *Pastae) ([]byte, error) {
 	if PASTAELIST == nil {
 		return []byte(""), errors.New("PASTAELIST is nil")
 	}
+	if pasta.BurnAfterReading {
+		PASTAEMUTEX.Lock()
+		current, ok := PASTAEMAP[pasta.ID]
+		if ok && current == pasta {
+			removePaste(pasta.ID)
+			tombstone(pasta.ID)
+		}
+		PASTAEMUTEX.Unlock()
+		if !ok || current != pasta {
+			return []byte(""), errors.New("paste already read")
+		}
+		if peersEnabled() {
+			claimed, contested := claimOnPeers(pasta.ID)
+			if !claimed {
+				if !contested {
+					restorePaste(pasta)
+				}
+				return []byte(""), errTombstoned
+			}
+		}
+	}
 	resp, err := decryptPaste(pasta)
 	if err != nil {
 		return []byte(err.Error()), err
 	}
-	if pasta.BurnAfterReading {
-		PASTAEMUTEX.Lock()
-		defer PASTAEMUTEX.Unlock()
-		delete(PASTAEMAP, PASTAELIST.Front().Value.(Pastae).ID)
-		PASTAELIST.Remove(PASTAELIST.Front())
-	}
 	return resp, nil
 }
 
@@ -131,3 +152,17 @@ func decryptPaste(paste *Pastae) ([]byte, error) {
 	zeroByteArray(sum)
 	return data, nil
 }
+
+// readPasteFile decrypts a persisted paste, id is its plaintext paste ID
+func readPasteFile(fname string, key []byte, nonce []byte, id string) ([]byte, error) {
+	file, err := readDataFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	lkey := tokenKey(id)
+	sum := kdf(key, lkey)
+	file, err = decrypt(file, sum[0:16], nonce)
+	zeroByteArray(sum)
+	zeroByteArray(lkey)
+	return file, err
+}
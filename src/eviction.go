@@ -0,0 +1,119 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Eviction policies applied when DatabaseMaxEntries is reached, an empty
+// policy evicts the oldest paste. Pinned pastes are never evicted.
+const evictOldest string = "oldest"
+const evictReject string = "reject"
+const evictExpiring string = "expiring"
+const evictHeaviest string = "heaviest"
+
+var errStorageFull = errors.New("storage full")
+
+// evictionQuery returns the query selecting the next paste to evict
+func evictionQuery(policy string) (string, error) {
+	switch policy {
+	case "", evictOldest:
+		return "SELECT id FROM data WHERE pinned = 0 ORDER BY id LIMIT 1", nil
+	case evictExpiring:
+		return "SELECT id FROM data WHERE pinned = 0 ORDER BY expire IS NULL, expire, id LIMIT 1", nil
+	case evictHeaviest:
+		return "SELECT id FROM data WHERE pinned = 0 AND uid = (SELECT uid FROM data WHERE pinned = 0 " +
+			"GROUP BY uid ORDER BY SUM(COALESCE(size,0)) DESC, COUNT(id) DESC LIMIT 1) ORDER BY id LIMIT 1", nil
+	case evictReject:
+		return "", errStorageFull
+	}
+	return "", errors.New("unknown eviction policy " + policy)
+}
+
+// evictPastes makes room for one more paste in tx and returns the data files
+// of the evicted pastes, which are removed once tx is committed
+func evictPastes(tx *sql.Tx) ([]string, error) {
+	if CONFIGURATION.DatabaseMaxEntries <= 0 {
+		return nil, nil
+	}
+	var count int64
+	err := tx.QueryRow("SELECT COUNT(id) FROM data").Scan(&count)
+	if err != nil {
+		return nil, err
+	}
+	if count < CONFIGURATION.DatabaseMaxEntries {
+		return nil, nil
+	}
+	query, err := evictionQuery(CONFIGURATION.EvictionPolicy)
+	if err != nil {
+		return nil, err
+	}
+	var fnames []string
+	for ; count >= CONFIGURATION.DatabaseMaxEntries; count-- {
+		var fname string
+		err = tx.QueryRow("DELETE FROM data WHERE id = (" + query + ") RETURNING fname").Scan(&fname)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errStorageFull
+		}
+		if err != nil {
+			return nil, err
+		}
+		fnames = append(fnames, fname)
+	}
+	return fnames, nil
+}
+
+func setPinned(db *sql.DB, uid int64, pid string, pinned bool) (bool, error) {
+	return execAffected(db, "UPDATE data SET pinned = $1 WHERE pid = $2 AND uid = $3", boolInt(pinned), pidKey(pid),
+		uid)
+}
+
+func storageFull(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusInsufficientStorage)
+	_, err := w.Write([]byte(errStorageFull.Error()))
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// pinHandler returns a handler pinning or unpinning a paste of the session
+// user. Pinned pastes are not evicted but count against the quota.
+func pinHandler(pinned bool) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if r == nil {
+			log.Println("http.Request is nil")
+			return
+		}
+		defer func() {
+			ec := r.Body.Close()
+			if ec != nil {
+				log.Println(ec.Error())
+			}
+		}()
+		sessid := sessionToken(r)
+		if sessid == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		uid, _, err := sessionValid(DB, sessid, scopeExpiry)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		ok, err := setPinned(DB, uid, p.ByName("id"), pinned)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
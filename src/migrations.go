@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Migration upgrades the schema by one version, either with SQL statements
+// or with a function for changes SQL can not express. Data migrates rows and
+// may rewrite blobs, which it must not write in a dry run, and returns the
+// blobs to remove once it is committed.
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+	Up      func(tx *sql.Tx) error
+	Data    func(tx *sql.Tx, dryRun bool) ([]string, error)
+}
+
+// builtinMigrations are the migrations written in Go, the embedded SQL
+// migrations fill in the versions missing here
+var builtinMigrations = []Migration{
+	{Version: 1, Name: "baseline", Up: baselineSchema},
+	{Version: 2, Name: "paste_names", Up: addColumns("data", "name TEXT", "dtoken BLOB")},
+	{Version: 4, Name: "accounts", Up: accountsSchema},
+	{Version: 5, Name: "legacy_users", Up: migrateLegacyUsers},
+	{Version: 6, Name: "wrapped_keks", Up: addColumns("users", "kek_salt BLOB", "kek_nonce BLOB")},
+	{Version: 7, Name: "paste_id_keys", Up: addColumns("data", "pid_enc BLOB")},
+	{Version: 8, Name: "legacy_pastes", Data: migrateLegacyPastes},
+	{Version: 10, Name: "totp", Up: addColumns("users", "totp_secret BLOB",
+		"totp_enabled INTEGER NOT NULL DEFAULT 0", "totp_last INTEGER", "totp_recovery TEXT")},
+	{Version: 11, Name: "registration", Up: registrationSchema},
+	{Version: 12, Name: "quotas", Up: addColumns("users", "quota_entries INTEGER", "quota_bytes INTEGER")},
+	{Version: 13, Name: "paste_sizes", Up: addColumns("data", "size INTEGER")},
+	{Version: 14, Name: "legacy_paste_sizes", Up: migratePasteSizes},
+	{Version: 15, Name: "pinned", Up: addColumns("data", "pinned INTEGER NOT NULL DEFAULT 0")},
+}
+
+// migrationLock is the PostgreSQL advisory lock held while migrating, so
+// that instances starting together do not race on the schema
+const migrationLock int64 = 0x70617374616500
+
+// Up-migrations named NNNN_name.sql, applied in order of NNNN. They are
+// written with SQLite column types, which ddl translates for PostgreSQL.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrations returns the built-in and the embedded migrations in order
+func migrations() ([]Migration, error) {
+	list := slices.Clone(builtinMigrations)
+	files, err := fs.Glob(migrationFiles, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		name := strings.TrimSuffix(path.Base(file), ".sql")
+		v, n, ok := strings.Cut(name, "_")
+		version, err := strconv.Atoi(v)
+		if !ok || err != nil || version < 2 {
+			return nil, errors.New("invalid migration file name " + file)
+		}
+		data, err := migrationFiles.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, Migration{Version: version, Name: n, SQL: string(data)})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Version < list[j].Version })
+	for i := 1; i < len(list); i++ {
+		if list[i].Version == list[i-1].Version {
+			return nil, fmt.Errorf("duplicate migration version %d", list[i].Version)
+		}
+	}
+	return list, nil
+}
+
+// schemaVersion returns the version of the schema, 0 before the baseline
+func schemaVersion(db *sql.DB) (int, error) {
+	ok, err := tableExists(db, "schema_version")
+	if err != nil || !ok {
+		return 0, err
+	}
+	var version int
+	err = db.QueryRow("SELECT COALESCE(MAX(version),0) FROM schema_version").Scan(&version)
+	return version, err
+}
+
+// migrateSchema applies pending migrations, each in its own transaction, and
+// returns them. A dry run applies them in one transaction which is rolled
+// back, so failing migrations are found without changing the database.
+func migrateSchema(db *sql.DB, dryRun bool) ([]Migration, error) {
+	all, err := migrations()
+	if err != nil {
+		return nil, err
+	}
+	if postgres() {
+		ctx := context.Background()
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			ec := conn.Close()
+			if ec != nil {
+				log.Println(ec.Error())
+			}
+		}()
+		_, err = conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLock)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			_, ec := conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", migrationLock)
+			if ec != nil {
+				log.Println(ec.Error())
+			}
+		}()
+	}
+	current, err := schemaVersion(db)
+	if err != nil {
+		return nil, err
+	}
+	var pending []Migration
+	for _, m := range all {
+		if m.Version > current {
+			pending = append(pending, m)
+		}
+	}
+	if len(pending) == 0 {
+		return nil, nil
+	}
+	var tx *sql.Tx
+	for _, m := range pending {
+		if tx == nil {
+			tx, err = db.Begin()
+			if err != nil {
+				return nil, err
+			}
+		}
+		obsolete, err := applyMigration(tx, m, dryRun)
+		if err != nil {
+			ec := tx.Rollback()
+			if ec != nil {
+				log.Println(ec.Error())
+			}
+			return nil, fmt.Errorf("migration %d %s: %w", m.Version, m.Name, err)
+		}
+		if dryRun {
+			continue
+		}
+		err = tx.Commit()
+		if err != nil {
+			return nil, err
+		}
+		tx = nil
+		for _, fname := range obsolete {
+			removeDataFile(fname)
+		}
+		log.Printf("Applied schema migration %d %s", m.Version, m.Name)
+	}
+	if tx != nil {
+		err = tx.Rollback()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return pending, nil
+}
+
+func applyMigration(tx *sql.Tx, m Migration, dryRun bool) ([]string, error) {
+	var obsolete []string
+	var err error
+	switch {
+	case m.Data != nil:
+		obsolete, err = m.Data(tx, dryRun)
+	case m.Up != nil:
+		err = m.Up(tx)
+	default:
+		_, err = tx.Exec(ddl(m.SQL))
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec("INSERT INTO schema_version (version, name, applied) VALUES ($1, $2, $3)",
+		m.Version, m.Name, time.Now().Unix())
+	return obsolete, err
+}
+
+// baselineSchema creates the schema of databases created before any of the
+// migrations, upgrading tables created by older versions in place
+func baselineSchema(tx *sql.Tx) error {
+	_, err := tx.Exec(ddl("CREATE TABLE IF NOT EXISTS schema_version (" +
+		"version INTEGER PRIMARY KEY," +
+		"name TEXT NOT NULL," +
+		"applied INTEGER NOT NULL)"))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ddl("CREATE TABLE IF NOT EXISTS users (" +
+		"id INTEGER PRIMARY KEY," +
+		"hash TEXT NOT NULL UNIQUE," +
+		"kek BLOB NOT NULL)"))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ddl("CREATE TABLE IF NOT EXISTS data (" +
+		"id INTEGER PRIMARY KEY," +
+		"uid INTEGER NOT NULL," +
+		"pid TEXT NOT NULL," +
+		"fname TEXT NOT NULL," +
+		"key BLOB NOT NULL," +
+		"nonce BLOB NOT NULL," +
+		"ct TEXT NOT NULL," +
+		"expire INTEGER)"))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("CREATE INDEX IF NOT EXISTS data_uid ON data (uid)")
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("CREATE UNIQUE INDEX IF NOT EXISTS data_pid ON data (pid)")
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("CREATE INDEX IF NOT EXISTS data_expire ON data (expire)")
+	return err
+}
+
+// accountsSchema adds usernames and password hashes
+func accountsSchema(tx *sql.Tx) error {
+	err := addColumns("users", "username TEXT", "password TEXT")(tx)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("CREATE UNIQUE INDEX IF NOT EXISTS users_username ON users (username)")
+	return err
+}
+
+// registrationSchema adds pending accounts and invite codes
+func registrationSchema(tx *sql.Tx) error {
+	err := addColumn(tx, "users", "pending", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ddl("CREATE TABLE IF NOT EXISTS invites (" +
+		"id INTEGER PRIMARY KEY," +
+		"code BLOB NOT NULL UNIQUE," +
+		"max_uses INTEGER NOT NULL," +
+		"uses INTEGER NOT NULL DEFAULT 0," +
+		"created INTEGER NOT NULL," +
+		"expire INTEGER," +
+		"created_by INTEGER)"))
+	return err
+}
+
+// addColumns returns a migration adding columns, given as "name definition",
+// to a table
+func addColumns(table string, columns ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, c := range columns {
+			column, definition, _ := strings.Cut(c, " ")
+			err := addColumn(tx, table, column, definition)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// addColumn adds a column to a table created by an older version
+func addColumn(tx *sql.Tx, table string, column string, definition string) error {
+	ok, err := columnExists(tx, table, column)
+	if err != nil || ok {
+		return err
+	}
+	_, err = tx.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + ddl(definition))
+	return err
+}
@@ -0,0 +1,12 @@
+-- Sessions stored in the database so that they survive restarts
+CREATE TABLE IF NOT EXISTS sessions (
+	id INTEGER PRIMARY KEY,
+	token BLOB NOT NULL UNIQUE,
+	uid INTEGER NOT NULL,
+	kek BLOB NOT NULL,
+	nonce BLOB NOT NULL,
+	created INTEGER NOT NULL,
+	last_seen INTEGER NOT NULL,
+	user_agent TEXT);
+CREATE INDEX IF NOT EXISTS sessions_uid ON sessions (uid);
+CREATE INDEX IF NOT EXISTS sessions_created ON sessions (created);
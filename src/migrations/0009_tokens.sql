@@ -0,0 +1,13 @@
+-- Scoped API tokens
+CREATE TABLE IF NOT EXISTS tokens (
+	id INTEGER PRIMARY KEY,
+	token BLOB NOT NULL UNIQUE,
+	uid INTEGER NOT NULL,
+	name TEXT,
+	scopes TEXT NOT NULL,
+	kek BLOB NOT NULL,
+	nonce BLOB NOT NULL,
+	created INTEGER NOT NULL,
+	expire INTEGER,
+	last_used INTEGER);
+CREATE INDEX IF NOT EXISTS tokens_uid ON tokens (uid);
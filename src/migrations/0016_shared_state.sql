@@ -0,0 +1,23 @@
+-- State shared by instances in sharedState mode: anonymous pastes, failed
+-- logins and pending OIDC logins
+CREATE TABLE IF NOT EXISTS ephemeral (
+	id INTEGER PRIMARY KEY,
+	pid TEXT NOT NULL,
+	key BLOB NOT NULL,
+	nonce BLOB NOT NULL,
+	ct TEXT NOT NULL,
+	name TEXT NOT NULL DEFAULT '',
+	dtoken BLOB,
+	burn INTEGER NOT NULL DEFAULT 0,
+	payload BLOB NOT NULL);
+CREATE UNIQUE INDEX IF NOT EXISTS ephemeral_pid ON ephemeral (pid);
+CREATE TABLE IF NOT EXISTS login_attempts (
+	akey TEXT PRIMARY KEY,
+	failures INTEGER NOT NULL,
+	last_failure INTEGER NOT NULL,
+	locked_until INTEGER NOT NULL DEFAULT 0);
+CREATE TABLE IF NOT EXISTS oidc_states (
+	state TEXT PRIMARY KEY,
+	verifier TEXT NOT NULL,
+	nonce TEXT NOT NULL,
+	created INTEGER NOT NULL);
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// OIDCProvider holds the parts of the OpenID provider metadata pastae uses
+type OIDCProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+}
+
+type OIDCLoginState struct {
+	Verifier string
+	Nonce    string
+	Created  int64
+}
+
+type OIDCClaims struct {
+	Issuer   string          `json:"iss"`
+	Subject  string          `json:"sub"`
+	Audience json.RawMessage `json:"aud"`
+	Expires  int64           `json:"exp"`
+	IssuedAt int64           `json:"iat"`
+	Nonce    string          `json:"nonce"`
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// Pending logins by state, they are only needed until the callback
+var OIDCSTATES = make(map[string]OIDCLoginState)
+var OIDCMUTEX sync.Mutex
+var OIDCHTTP = &http.Client{Timeout: 10 * time.Second}
+
+const oidcStateCookie string = "pastae-oidc-state"
+const oidcStateLifetime int64 = 600
+
+// saveOIDCState keeps a pending login until the callback and drops expired ones
+func saveOIDCState(state string, login OIDCLoginState) error {
+	if sharedState() {
+		return saveSharedOIDCState(state, login)
+	}
+	OIDCMUTEX.Lock()
+	defer OIDCMUTEX.Unlock()
+	for s, l := range OIDCSTATES {
+		if l.Created <= login.Created-oidcStateLifetime {
+			delete(OIDCSTATES, s)
+		}
+	}
+	OIDCSTATES[state] = login
+	return nil
+}
+
+func takeOIDCState(state string) (OIDCLoginState, bool) {
+	if sharedState() {
+		return takeSharedOIDCState(state)
+	}
+	OIDCMUTEX.Lock()
+	defer OIDCMUTEX.Unlock()
+	login, ok := OIDCSTATES[state]
+	delete(OIDCSTATES, state)
+	return login, ok
+}
+
+func oidcEnabled() bool {
+	return CONFIGURATION.Database && CONFIGURATION.OIDCIssuer != "" && CONFIGURATION.OIDCClientID != ""
+}
+
+func oidcRouter() *httprouter.Router {
+	mux := httprouter.New()
+	mux.GET("/session/oidc/login", oidcLoginHandler)
+	mux.GET("/session/oidc/callback", oidcCallbackHandler)
+	return mux
+}
+
+func oidcRedirectURI() string {
+	return CONFIGURATION.URL + "session/oidc/callback"
+}
+
+func oidcGetJSON(u string, v any) error {
+	resp, err := OIDCHTTP.Get(u)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		ec := resp.Body.Close()
+		if ec != nil {
+			log.Println(ec.Error())
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("GET " + u + ": " + resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+func oidcDiscover() (OIDCProvider, error) {
+	var provider OIDCProvider
+	issuer := strings.TrimSuffix(CONFIGURATION.OIDCIssuer, "/")
+	err := oidcGetJSON(issuer+"/.well-known/openid-configuration", &provider)
+	if err != nil {
+		return provider, err
+	}
+	if strings.TrimSuffix(provider.Issuer, "/") != issuer {
+		return provider, errors.New("issuer mismatch in provider metadata")
+	}
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" || provider.JwksURI == "" {
+		return provider, errors.New("incomplete provider metadata")
+	}
+	return provider, nil
+}
+
+func randomURLString(n int) (string, error) {
+	b, err := generateRandomBytes(n)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// oidcLoginHandler redirects the browser to the provider with a fresh state,
+// nonce and PKCE challenge
+func oidcLoginHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	provider, err := oidcDiscover()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	state, err := randomURLString(32)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	nonce, err := randomURLString(32)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	verifier, err := randomURLString(48)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	err = saveOIDCState(state, OIDCLoginState{Verifier: verifier, Nonce: nonce, Created: time.Now().Unix()})
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	// the callback is a cross-site navigation so the state cookie must be Lax
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Value: state, Path: "/session/oidc/",
+		MaxAge: int(oidcStateLifetime), HttpOnly: true, Secure: cookieSecure(r), SameSite: http.SameSiteLaxMode})
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", CONFIGURATION.OIDCClientID)
+	v.Set("redirect_uri", oidcRedirectURI())
+	v.Set("scope", "openid")
+	v.Set("state", state)
+	v.Set("nonce", nonce)
+	v.Set("code_challenge", pkceChallenge(verifier))
+	v.Set("code_challenge_method", "S256")
+	sep := "?"
+	if strings.Contains(provider.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, provider.AuthorizationEndpoint+sep+v.Encode(), http.StatusFound)
+}
+
+// oidcCallbackHandler exchanges the authorization code, verifies the ID token
+// and logs the user in with a cookie session
+func oidcCallbackHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	state := r.URL.Query().Get("state")
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Value: "", Path: "/session/oidc/", MaxAge: -1,
+		HttpOnly: true, Secure: cookieSecure(r), SameSite: http.SameSiteLaxMode})
+	login, ok := takeOIDCState(state)
+	if !ok || login.Created <= time.Now().Unix()-oidcStateLifetime {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	code := r.URL.Query().Get("code")
+	if code == "" {
+		log.Println("oidc error:", r.URL.Query().Get("error"))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	provider, err := oidcDiscover()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	idToken, err := oidcExchange(provider, code, login.Verifier)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	claims, err := oidcVerify(provider, idToken, login.Nonce)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	uid, kek, err := oidcUser(DB, claims.Issuer, claims.Subject)
+	if errors.Is(err, errPendingApproval) || errors.Is(err, errRegistrationClosed) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	sid, err := createSession(DB, uid, kek, r.UserAgent())
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	setSessionCookies(w, r, sid)
+	http.Redirect(w, r, CONFIGURATION.URL, http.StatusSeeOther)
+}
+
+func oidcExchange(provider OIDCProvider, code string, verifier string) (string, error) {
+	v := url.Values{}
+	v.Set("grant_type", "authorization_code")
+	v.Set("code", code)
+	v.Set("redirect_uri", oidcRedirectURI())
+	v.Set("client_id", CONFIGURATION.OIDCClientID)
+	v.Set("code_verifier", verifier)
+	req, err := http.NewRequest(http.MethodPost, provider.TokenEndpoint, strings.NewReader(v.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("content-type", "application/x-www-form-urlencoded")
+	if CONFIGURATION.OIDCClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(CONFIGURATION.OIDCClientID), url.QueryEscape(CONFIGURATION.OIDCClientSecret))
+	}
+	resp, err := OIDCHTTP.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		ec := resp.Body.Close()
+		if ec != nil {
+			log.Println(ec.Error())
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New("token endpoint: " + resp.Status)
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tokens)
+	if err != nil {
+		return "", err
+	}
+	if tokens.IDToken == "" {
+		return "", errors.New("no id_token in token response")
+	}
+	return tokens.IDToken, nil
+}
+
+// oidcVerify checks the signature of an ID token against the provider keys
+// and validates its issuer, audience, lifetime and nonce
+func oidcVerify(provider OIDCProvider, token string, nonce string) (OIDCClaims, error) {
+	var claims OIDCClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, errors.New("malformed id_token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err := jwtDecodePart(parts[0], &header)
+	if err != nil {
+		return claims, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, err
+	}
+	var jwks struct {
+		Keys []JWK `json:"keys"`
+	}
+	err = oidcGetJSON(provider.JwksURI, &jwks)
+	if err != nil {
+		return claims, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	verified := false
+	for _, key := range jwks.Keys {
+		if header.Kid != "" && key.Kid != header.Kid {
+			continue
+		}
+		if jwkVerify(key, header.Alg, digest[:], sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return claims, errors.New("invalid id_token signature")
+	}
+	err = jwtDecodePart(parts[1], &claims)
+	if err != nil {
+		return claims, err
+	}
+	now := time.Now().Unix()
+	if claims.Issuer != provider.Issuer {
+		return claims, errors.New("invalid id_token issuer")
+	}
+	if !oidcAudience(claims.Audience, CONFIGURATION.OIDCClientID) {
+		return claims, errors.New("invalid id_token audience")
+	}
+	if claims.Expires <= now || claims.IssuedAt > now+300 {
+		return claims, errors.New("expired id_token")
+	}
+	if subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 {
+		return claims, errors.New("invalid id_token nonce")
+	}
+	if claims.Subject == "" {
+		return claims, errors.New("no subject in id_token")
+	}
+	return claims, nil
+}
+
+func jwtDecodePart(part string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func oidcAudience(aud json.RawMessage, clientID string) bool {
+	var single string
+	if json.Unmarshal(aud, &single) == nil {
+		return single == clientID
+	}
+	var list []string
+	if json.Unmarshal(aud, &list) != nil {
+		return false
+	}
+	for _, a := range list {
+		if a == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// jwkVerify supports RS256 and ES256, the algorithms providers commonly use
+func jwkVerify(key JWK, alg string, digest []byte, sig []byte) bool {
+	switch {
+	case alg == "RS256" && key.Kty == "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(key.N)
+		if err != nil {
+			return false
+		}
+		e, err := base64.RawURLEncoding.DecodeString(key.E)
+		if err != nil || len(e) > 4 {
+			return false
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, sig) == nil
+	case alg == "ES256" && key.Kty == "EC" && key.Crv == "P-256":
+		x, err := base64.RawURLEncoding.DecodeString(key.X)
+		if err != nil {
+			return false
+		}
+		y, err := base64.RawURLEncoding.DecodeString(key.Y)
+		if err != nil || len(sig) != 64 {
+			return false
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		return ecdsa.Verify(pub, digest, new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:]))
+	}
+	return false
+}
+
+// oidcKekKey derives the key wrapping the KEK of an OIDC user. These users
+// have no password, so the key comes from the configured OIDC KEK secret.
+func oidcKekKey(hash string) []byte {
+	sum := sha512.Sum512([]byte("pastae-oidc-kek" + CONFIGURATION.OIDCKekSecret + hash))
+	return sum[0:16]
+}
+
+// oidcUser returns the user of an issuer and subject, creating the user and
+// its KEK on first login
+func oidcUser(db *sql.DB, issuer string, subject string) (int64, []byte, error) {
+	if db == nil {
+		return 0, nil, errors.New("nil db")
+	}
+	if CONFIGURATION.OIDCKekSecret == "" {
+		return 0, nil, errors.New("oidcKekSecret is not configured")
+	}
+	hash := "oidc:" + issuer + "#" + subject
+	key := oidcKekKey(hash)
+	defer zeroByteArray(key)
+	var uid int64
+	var wrapped []byte
+	var nonce []byte
+	var pending bool
+	err := db.QueryRow("SELECT id, kek, kek_nonce, pending FROM users WHERE hash = $1", hash).Scan(
+		&uid, &wrapped, &nonce, &pending)
+	if err == nil {
+		if pending {
+			return 0, nil, errPendingApproval
+		}
+		kek, err := decrypt(wrapped, key, nonce)
+		if err != nil {
+			return 0, nil, err
+		}
+		return uid, kek, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return 0, nil, err
+	}
+	// The first login creates the account as RegistrationMode allows, there is
+	// no way to pass an invite code through the provider
+	switch CONFIGURATION.RegistrationMode {
+	case "", registrationOpen:
+	case registrationApproval:
+		pending = true
+	default:
+		return 0, nil, errRegistrationClosed
+	}
+	kek, err := generateRandomBytes(64)
+	if err != nil {
+		return 0, nil, err
+	}
+	nonce, err = generateRandomBytes(12)
+	if err != nil {
+		return 0, nil, err
+	}
+	wrapped, err = encrypt(kek, key, nonce)
+	if err != nil {
+		return 0, nil, err
+	}
+	err = db.QueryRow("INSERT INTO users (hash, kek, kek_nonce, pending) VALUES ($1, $2, $3, $4) RETURNING id",
+		hash, wrapped, nonce, boolInt(pending)).Scan(&uid)
+	if err != nil {
+		zeroByteArray(kek)
+		return 0, nil, err
+	}
+	if pending {
+		zeroByteArray(kek)
+		return 0, nil, errPendingApproval
+	}
+	return uid, kek, nil
+}
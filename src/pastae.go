@@ -5,38 +5,72 @@ import (
 	"crypto/tls"
 	"database/sql"
 	"encoding/json"
-	"io"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	_ "github.com/glebarez/go-sqlite"
 	"github.com/julienschmidt/httprouter"
 )
 
 type Configuration struct {
-	URL                  string        `json:"url"`
-	Listen               string        `json:"listen"`
-	FrontPage            string        `json:"frontPage"`
-	ReadTimeout          time.Duration `json:"readTimeout"`
-	WriteTimeout         time.Duration `json:"writeTimeout"`
-	MaxEntries           int           `json:"maxEntries"`
-	MaxEntrySize         int64         `json:"maxEntrySize"`
-	MaxHeaderBytes       int           `json:"maxHeaderBytes"`
-	TLS                  bool          `json:"tls"`
-	TLSCert              string        `json:"tlsCert"`
-	TLSKey               string        `json:"tlsKey"`
-	DataPath             string        `json:"dataPath"`
-	Database             bool          `json:"database"`
-	DatabasePersistUser  string        `json:"databasePersistUser"`
-	DatabaseTimeout      int64         `json:"databaseTimeout"`
-	DatabaseMaxEntries   int64         `json:"databaseMaxEntries"`
-	DatabaseMaxEntrySize int64         `json:"databaseMaxEntrySize"`
-	DatabaseFile         string        `json:"databaseFile"`
+	URL                     string        `json:"url"`
+	Listen                  string        `json:"listen"`
+	FrontPage               string        `json:"frontPage"`
+	ReadTimeout             time.Duration `json:"readTimeout"`
+	WriteTimeout            time.Duration `json:"writeTimeout"`
+	MaxEntries              int           `json:"maxEntries"`
+	MaxEntrySize            int64         `json:"maxEntrySize"`
+	MaxHeaderBytes          int           `json:"maxHeaderBytes"`
+	ContentTypes            []string      `json:"contentTypes"`
+	TLS                     bool          `json:"tls"`
+	TLSCert                 string        `json:"tlsCert"`
+	TLSKey                  string        `json:"tlsKey"`
+	DataPath                string        `json:"dataPath"`
+	BlobStore               string        `json:"blobStore"`
+	S3Endpoint              string        `json:"s3Endpoint"`
+	S3Region                string        `json:"s3Region"`
+	S3Bucket                string        `json:"s3Bucket"`
+	S3Prefix                string        `json:"s3Prefix"`
+	S3AccessKey             string        `json:"s3AccessKey"`
+	S3SecretKey             string        `json:"s3SecretKey"`
+	Database                bool          `json:"database"`
+	DatabasePersistUser     string        `json:"databasePersistUser"`
+	DatabaseTimeout         int64         `json:"databaseTimeout"`
+	DatabaseSessionLifetime int64         `json:"databaseSessionLifetime"`
+	DatabaseMaxEntries      int64         `json:"databaseMaxEntries"`
+	EvictionPolicy          string        `json:"evictionPolicy"`
+	DatabaseMaxEntrySize    int64         `json:"databaseMaxEntrySize"`
+	DatabaseFile            string        `json:"databaseFile"`
+	DatabaseDriver          string        `json:"databaseDriver"`
+	DatabaseURL             string        `json:"databaseUrl"`
+	SharedState             bool          `json:"sharedState"`
+	Peers                   []string      `json:"peers"`
+	PeerListen              string        `json:"peerListen"`
+	PeerCert                string        `json:"peerCert"`
+	PeerKey                 string        `json:"peerKey"`
+	PeerCA                  string        `json:"peerCA"`
+	QuotaMaxEntries         int64         `json:"quotaMaxEntries"`
+	QuotaMaxBytes           int64         `json:"quotaMaxBytes"`
+	PersistQuotaMaxEntries  int64         `json:"persistQuotaMaxEntries"`
+	PersistQuotaMaxBytes    int64         `json:"persistQuotaMaxBytes"`
+	RegistrationMode        string        `json:"registrationMode"`
+	Admins                  []string      `json:"admins"`
+	LoginMaxAttempts        int           `json:"loginMaxAttempts"`
+	LoginBackoff            int64         `json:"loginBackoff"`
+	LoginLockout            int64         `json:"loginLockout"`
+	OIDCIssuer              string        `json:"oidcIssuer"`
+	OIDCClientID            string        `json:"oidcClientId"`
+	OIDCClientSecret        string        `json:"oidcClientSecret"`
+	OIDCKekSecret           string        `json:"oidcKekSecret"`
 }
 
 type Pastae struct {
@@ -46,30 +80,57 @@ type Pastae struct {
 	Key              []byte
 	Nonce            []byte
 	Payload          []byte
+	Name             string
+	DeleteToken      []byte
+}
+
+type RawUploadResponse struct {
+	URL         string `json:"url"`
+	DeleteToken string `json:"deleteToken"`
 }
 
 type PastaeListing struct {
 	ID          string
 	Expire      int64
 	ContentType string
+	Pinned      bool
 }
 
 var CONFIGURATION Configuration
 var PASTAEMAP map[string]*Pastae
 var PASTAELIST *list.List
 var PASTAEMUTEX sync.RWMutex
-var SESSIONMUTEX sync.RWMutex
-var SESSIONS map[string]*Session
 var SESSIONPASTECOUNT atomic.Int64
 var KEK []byte
 var FRONTPAGE []byte
 var DB *sql.DB
 
 func main() {
+	dryRun := flag.Bool("migrate-dry-run", false, "list pending schema migrations without applying them and exit")
+	fsckRepair := flag.Bool("fsck-repair", false, "remove orphan and temporary data files older than an hour and exit")
+	flag.Parse()
 	err := readConfig("pastae.json")
 	if err != nil {
 		log.Fatal(err)
 	}
+	switch flag.Arg(0) {
+	case "":
+	case "backup", "restore":
+		err = backupCommand(flag.Arg(0), flag.Arg(1))
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	default:
+		log.Fatal("unknown command " + flag.Arg(0))
+	}
+	if *dryRun {
+		err = migrateDryRun()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	PASTAEMAP = make(map[string]*Pastae)
 	PASTAELIST = list.New()
 	KEK, err = generateRandomBytes(1024)
@@ -79,11 +140,13 @@ func main() {
 
 	pasteServer := servePaste
 	uploadServer := uploadPaste
+	rawServer := uploadRaw
 	if CONFIGURATION.Database {
-		if _, err := os.Stat(CONFIGURATION.DataPath); os.IsNotExist(err) {
-			log.Fatal("SessionPath (" + CONFIGURATION.DataPath + ") does not exist")
+		BLOBS, err = openBlobStore()
+		if err != nil {
+			log.Fatal(err)
 		}
-		DB, err = sql.Open("sqlite", CONFIGURATION.DatabaseFile)
+		DB, err = openDatabase()
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -95,42 +158,78 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
-		SESSIONS = make(map[string]*Session)
-		go sessionCleaner(time.Minute)
+		report, err := fsckDataPath(DB, *fsckRepair)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *fsckRepair {
+			log.Printf("fsck: removed %d orphan and %d temporary files, %d pastes have missing files",
+				len(report.OrphanFiles), len(report.TempFiles), len(report.MissingFiles))
+			return
+		}
+		if len(report.OrphanFiles)+len(report.MissingFiles)+len(report.TempFiles) > 0 {
+			log.Printf("fsck: %d orphan and %d temporary files, %d pastes have missing files, "+
+				"run with -fsck-repair to remove the files", len(report.OrphanFiles), len(report.TempFiles),
+				len(report.MissingFiles))
+		}
+		go sessionCleaner(DB, time.Minute)
 		go expiredCleaner(DB, time.Minute)
 		pasteServer = servePasteS
 		uploadServer = uploadPasteS
-		l := len(CONFIGURATION.DataPath)
-		if l > 0 {
-			if CONFIGURATION.DataPath[l-1] != '/' {
-				CONFIGURATION.DataPath += "/"
-			}
+		rawServer = uploadRawS
+		err = refreshPasteCount(DB)
+		if err != nil {
+			log.Fatal(err)
 		}
-		var tmpCount int64 = 0
-		err = DB.QueryRow("SELECT COUNT(id) FROM data").Scan(&tmpCount)
+	}
+
+	if peersEnabled() {
+		err = startPeers()
 		if err != nil {
 			log.Fatal(err)
 		}
-		SESSIONPASTECOUNT.Store(tmpCount)
 	}
 
 	mux := httprouter.New()
 	mux.GET("/", serveFrontPage)
 	mux.GET("/:id", pasteServer)
 	mux.POST("/upload", uploadServer)
+	mux.POST("/raw", rawServer)
+	mux.PUT("/raw", rawServer)
+	mux.PUT("/raw/:filename", rawServer)
+	mux.DELETE("/:id", deleteHandler)
 	if CONFIGURATION.Database {
 		mux.POST("/session/list", pasteList)
 		mux.POST("/session/register", registerUserHandler)
 		mux.POST("/session/login", loginHandler)
 		mux.POST("/session/logout", logoutHandler)
 		mux.POST("/expiry/:id/:days", expiry)
+		mux.POST("/session/pin/:id", pinHandler(true))
+		mux.POST("/session/unpin/:id", pinHandler(false))
 		mux.POST("/session/ping", pingHandler)
-		mux.DELETE("/:id", deleteHandler)
+		mux.POST("/session/password", passwordHandler)
+		mux.POST("/session/sessions", sessionsHandler)
+		mux.POST("/session/revoke/:id", revokeSessionHandler)
+		mux.POST("/session/totp/setup", totpSetupHandler)
+		mux.POST("/session/totp/enable", totpEnableHandler)
+		mux.POST("/session/totp/disable", totpDisableHandler)
+		mux.POST("/session/tokens", tokensHandler)
+		mux.POST("/session/tokens/create", createTokenHandler)
+		mux.POST("/session/tokens/revoke/:id", revokeTokenHandler)
+		mux.POST("/session/export", exportHandler)
+		mux.POST("/session/delete", deleteAccountHandler)
+		mux.POST("/session/admin/invites", invitesHandler)
+		mux.POST("/session/admin/invites/create", createInviteHandler)
+		mux.POST("/session/admin/invites/revoke/:id", adminIDHandler(deleteInvite))
+		mux.POST("/session/admin/pending", pendingUsersHandler)
+		mux.POST("/session/admin/approve/:id", adminIDHandler(approveUser))
+		mux.POST("/session/admin/reject/:id", adminIDHandler(rejectUser))
+		mux.POST("/session/admin/quota/:id", setQuotaHandler)
 	}
 	tlsConfig := &tls.Config{PreferServerCipherSuites: true, MinVersion: tls.VersionTLS12}
 	s := &http.Server{
 		Addr:           CONFIGURATION.Listen,
-		Handler:        mux,
+		Handler:        newHandler(mux),
 		TLSConfig:      tlsConfig,
 		ReadTimeout:    CONFIGURATION.ReadTimeout * time.Second,
 		WriteTimeout:   CONFIGURATION.WriteTimeout * time.Second,
@@ -143,6 +242,41 @@ func main() {
 	}
 }
 
+// migrateDryRun applies pending schema migrations in a transaction which is
+// rolled back and lists them
+func migrateDryRun() error {
+	if !CONFIGURATION.Database {
+		return errors.New("database is not enabled")
+	}
+	// data migrations read the blobs during the dry run too
+	var err error
+	BLOBS, err = openBlobStore()
+	if err != nil {
+		return err
+	}
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		ec := db.Close()
+		if ec != nil {
+			log.Println(ec.Error())
+		}
+	}()
+	pending, err := migrateSchema(db, true)
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		fmt.Println("schema is up to date")
+	}
+	for _, m := range pending {
+		fmt.Printf("%04d %s\n", m.Version, m.Name)
+	}
+	return nil
+}
+
 func readConfig(file string) error {
 	c, err := os.ReadFile(file)
 	if err != nil {
@@ -158,6 +292,38 @@ func readConfig(file string) error {
 			CONFIGURATION.URL += "/"
 		}
 	}
+	l = len(CONFIGURATION.DataPath)
+	if l > 0 {
+		if CONFIGURATION.DataPath[l-1] != '/' {
+			CONFIGURATION.DataPath += "/"
+		}
+	}
+	if CONFIGURATION.SharedState && (!CONFIGURATION.Database || CONFIGURATION.DatabaseDriver != driverPostgres) {
+		return errors.New("sharedState requires the database with databaseDriver postgres")
+	}
+	if len(CONFIGURATION.Peers) > 0 {
+		if CONFIGURATION.SharedState {
+			return errors.New("peers can not be used with sharedState")
+		}
+		if CONFIGURATION.PeerListen == "" || CONFIGURATION.PeerCert == "" || CONFIGURATION.PeerKey == "" ||
+			CONFIGURATION.PeerCA == "" {
+			return errors.New("peers require peerListen, peerCert, peerKey and peerCA")
+		}
+		for i, peer := range CONFIGURATION.Peers {
+			CONFIGURATION.Peers[i] = strings.TrimSuffix(peer, "/")
+		}
+	}
+	if !slices.Contains([]string{"", registrationOpen, registrationInvite, registrationApproval, registrationClosed},
+		CONFIGURATION.RegistrationMode) {
+		return errors.New("unknown registrationMode " + CONFIGURATION.RegistrationMode)
+	}
+	if CONFIGURATION.LoginMaxAttempts > 0 && (CONFIGURATION.LoginLockout <= 0 || CONFIGURATION.LoginBackoff <= 0) {
+		return errors.New("loginMaxAttempts requires positive loginBackoff and loginLockout")
+	}
+	_, err = evictionQuery(CONFIGURATION.EvictionPolicy)
+	if err != nil && err != errStorageFull {
+		return err
+	}
 	FRONTPAGE, err = os.ReadFile(CONFIGURATION.FrontPage)
 	if err != nil {
 		return err
@@ -193,17 +359,24 @@ func pasteList(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 			log.Println(ec.Error())
 		}
 	}()
-	sessid := r.Header.Get("pastae-sessid")
+	sessid := sessionToken(r)
 	if sessid == "" {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
-	uid, _, err := sessionValid(DB, sessid)
+	uid, kek, err := sessionValid(DB, sessid, scopeList)
 	if err != nil {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
-	res, err := DB.Query("SELECT pid,COALESCE(expire,0) as ex,ct FROM data WHERE uid = $1", uid)
+	q, err := userQuota(DB, uid)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	setQuotaHeaders(w, q)
+	res, err := DB.Query("SELECT pid_enc,COALESCE(expire,0) as ex,ct,pinned FROM data WHERE uid = $1", uid)
 	if err != nil {
 		ec := res.Close()
 		if ec != nil {
@@ -222,11 +395,18 @@ func pasteList(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	for res.Next() {
 		var elem PastaeListing
 		var expireUnix int64
-		err = res.Scan(&elem.ID, &expireUnix, &elem.ContentType)
+		var pidEnc []byte
+		err = res.Scan(&pidEnc, &expireUnix, &elem.ContentType, &elem.Pinned)
 		if err != nil {
 			log.Println(err)
 			continue
 		}
+		pid, err := openWithKek(pidEnc, kek)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		elem.ID = string(pid)
 		elem.Expire = expireUnix / (60 * 60 * 24)
 		resp = append(resp, elem)
 	}
@@ -253,12 +433,12 @@ func expiry(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 			log.Println(ec.Error())
 		}
 	}()
-	sessid := r.Header.Get("pastae-sessid")
+	sessid := sessionToken(r)
 	if sessid == "" {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
-	uid, _, err := sessionValid(DB, sessid)
+	uid, _, err := sessionValid(DB, sessid, scopeExpiry)
 	if err != nil {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
@@ -270,7 +450,7 @@ func expiry(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		return
 	}
 	t := time.Now().Unix() + days*60*60*24
-	_, err = DB.Exec("UPDATE data SET expire = $1 WHERE pid = $2 AND uid = $3", t, id, uid)
+	_, err = DB.Exec("UPDATE data SET expire = $1 WHERE pid = $2 AND uid = $3", t, pidKey(id), uid)
 	if err != nil {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
@@ -285,57 +465,21 @@ func pingHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 			log.Println(ec.Error())
 		}
 	}()
-	sessid := r.Header.Get("pastae-sessid")
+	sessid := sessionToken(r)
 	if sessid == "" {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
-	_, _, err := sessionValid(DB, sessid)
+	_, _, err := sessionValid(DB, sessid, scopeSession)
 	if err != nil {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
-	updateSessionCreationTime(sessid)
 	w.WriteHeader(http.StatusOK)
 }
 
-func updateSessionCreationTime(sessid string) {
-	SESSIONMUTEX.Lock()
-	defer SESSIONMUTEX.Unlock()
-	sessionData := SESSIONS[sessid]
-	sessionData.Created = time.Now().Unix()
-	SESSIONS[sessid] = sessionData
-}
-
 func createDBTablesAndIndexes(db *sql.DB) error {
-	_, err := db.Exec("CREATE TABLE IF NOT EXISTS users (" +
-		"id INTEGER PRIMARY KEY," +
-		"hash TEXT NOT NULL UNIQUE," +
-		"kek BLOB NOT NULL)")
-	if err != nil {
-		return err
-	}
-	_, err = db.Exec("CREATE TABLE IF NOT EXISTS data (" +
-		"id INTEGER PRIMARY KEY," +
-		"uid INTEGER NOT NULL," +
-		"pid TEXT NOT NULL," +
-		"fname TEXT NOT NULL," +
-		"key BLOB NOT NULL," +
-		"nonce BLOB NOT NULL," +
-		"ct TEXT NOT NULL," +
-		"expire INTEGER)")
-	if err != nil {
-		return err
-	}
-	_, err = db.Exec("CREATE INDEX IF NOT EXISTS data_uid ON data (uid)")
-	if err != nil {
-		return err
-	}
-	_, err = db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS data_pid ON data (pid)")
-	if err != nil {
-		return err
-	}
-	_, err = db.Exec("CREATE INDEX IF NOT EXISTS data_expire ON data (expire)")
+	_, err := migrateSchema(db, false)
 	if err != nil {
 		return err
 	}
@@ -363,25 +507,35 @@ func registerUserHandler(w http.ResponseWriter, r *http.Request, p httprouter.Pa
 			log.Println(ec.Error())
 		}
 	}()
-	hash, err := io.ReadAll(io.LimitReader(r.Body, 100))
-	defer func() {
-		ec := r.Body.Close()
-		if ec != nil {
-			log.Println(ec.Error())
-		}
-	}()
+	keys := registerKeys(r)
+	if wait := loginLocked(keys...); wait > 0 {
+		tooManyRequests(w, wait)
+		return
+	}
+	username, password, err := readCredentials(w, r)
 	if err != nil {
 		log.Println(err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	err = registerUser(DB, string(hash))
+	// every registration counts to limit account creation and probing
+	loginFailed(keys...)
+	pending, err := registerWithMode(DB, username, password, r.PostFormValue("invite"))
 	if err == nil {
-		_, err = w.Write([]byte("OK"))
+		resp := "OK"
+		if pending {
+			resp = "PENDING"
+			w.WriteHeader(http.StatusAccepted)
+		}
+		_, err = w.Write([]byte(resp))
 		if err != nil {
 			log.Println(err.Error())
 		}
+	} else if errors.Is(err, errRegistrationClosed) || errors.Is(err, errInvalidInvite) {
+		w.WriteHeader(http.StatusForbidden)
+		return
 	} else {
+		log.Println(err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
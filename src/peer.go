@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// In-memory pastes are replicated to the Peers over TLS where both sides
+// present a certificate signed by PeerCA. Reading a burn after reading paste
+// claims it on the peers, and it is served only if a majority of all nodes
+// grant the claim, so two nodes can never both serve it. A claim leaves a
+// tombstone which also stops the paste from being replicated later.
+const peerTimeout time.Duration = 5 * time.Second
+const peerTombstoneLifetime int64 = 3600
+
+// PeerPaste is an in-memory paste as sent to peers. The content is protected
+// by TLS and every node encrypts it with its own KEK.
+type PeerPaste struct {
+	ID               string `json:"id"`
+	ContentType      string `json:"contentType"`
+	BurnAfterReading bool   `json:"burnAfterReading"`
+	Name             string `json:"name"`
+	DeleteToken      []byte `json:"deleteToken"`
+	Data             []byte `json:"data"`
+}
+
+var errTombstoned = errors.New("paste already claimed")
+
+// TOMBSTONES holds the claim time of burned and deleted pastes, it is
+// guarded by PASTAEMUTEX
+var TOMBSTONES = make(map[string]int64)
+var PEERHTTP *http.Client
+
+func peersEnabled() bool {
+	return len(CONFIGURATION.Peers) > 0
+}
+
+// peerTLSConfig requires and verifies a client certificate signed by PeerCA
+// and presents PeerCert to both clients and servers
+func peerTLSConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(CONFIGURATION.PeerCert, CONFIGURATION.PeerKey)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := os.ReadFile(CONFIGURATION.PeerCA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("no certificates in " + CONFIGURATION.PeerCA)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, RootCAs: pool, ClientCAs: pool,
+		ClientAuth: tls.RequireAndVerifyClientCert, MinVersion: tls.VersionTLS12}, nil
+}
+
+// startPeers listens for peers on PeerListen and sets up the peer client
+func startPeers() error {
+	tlsConfig, err := peerTLSConfig()
+	if err != nil {
+		return err
+	}
+	PEERHTTP = &http.Client{Timeout: peerTimeout, Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	l, err := net.Listen("tcp", CONFIGURATION.PeerListen)
+	if err != nil {
+		return err
+	}
+	s := &http.Server{
+		Handler:        peerRouter(),
+		TLSConfig:      tlsConfig,
+		ReadTimeout:    peerTimeout,
+		WriteTimeout:   peerTimeout,
+		MaxHeaderBytes: CONFIGURATION.MaxHeaderBytes,
+	}
+	go func() {
+		log.Fatal(s.ServeTLS(l, "", ""))
+	}()
+	go tombstoneCleaner(time.Minute)
+	return nil
+}
+
+func peerRouter() *httprouter.Router {
+	mux := httprouter.New()
+	mux.POST("/peer/paste", peerPasteHandler)
+	mux.POST("/peer/claim/:id", peerClaimHandler)
+	mux.POST("/peer/delete/:id", peerDeleteHandler)
+	return mux
+}
+
+func tombstoneCleaner(sleepTime time.Duration) {
+	for {
+		time.Sleep(sleepTime)
+		cleanTombstones()
+	}
+}
+
+func cleanTombstones() {
+	limit := time.Now().Unix() - peerTombstoneLifetime
+	PASTAEMUTEX.Lock()
+	defer PASTAEMUTEX.Unlock()
+	for id, claimed := range TOMBSTONES {
+		if claimed <= limit {
+			delete(TOMBSTONES, id)
+		}
+	}
+}
+
+// tombstone records that a paste is gone, PASTAEMUTEX must be held
+func tombstone(id string) {
+	if peersEnabled() {
+		TOMBSTONES[id] = time.Now().Unix()
+	}
+}
+
+// claimPaste removes an in-memory paste and leaves a tombstone. It fails if
+// the paste was claimed before.
+func claimPaste(id string) bool {
+	PASTAEMUTEX.Lock()
+	defer PASTAEMUTEX.Unlock()
+	if _, ok := TOMBSTONES[id]; ok {
+		return false
+	}
+	TOMBSTONES[id] = time.Now().Unix()
+	removePaste(id)
+	return true
+}
+
+// deleteMemoryPaste removes an in-memory paste if hash matches its deletion
+// token
+func deleteMemoryPaste(pid string, hash []byte) bool {
+	PASTAEMUTEX.Lock()
+	defer PASTAEMUTEX.Unlock()
+	paste, ok := PASTAEMAP[pid]
+	if !ok || len(paste.DeleteToken) == 0 || subtle.ConstantTimeCompare(paste.DeleteToken, hash) != 1 {
+		return false
+	}
+	removePaste(pid)
+	tombstone(pid)
+	return true
+}
+
+// peerBroadcast posts body to path on all peers in parallel and returns the
+// number of peers answering 200 and 409
+func peerBroadcast(path string, body []byte) (int, int) {
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	ok, conflicts := 0, 0
+	for _, peer := range CONFIGURATION.Peers {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			resp, err := PEERHTTP.Post(peer+path, "application/octet-stream", bytes.NewReader(body))
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			_, err = io.Copy(io.Discard, resp.Body)
+			ec := resp.Body.Close()
+			if err == nil {
+				err = ec
+			}
+			if err != nil {
+				log.Println(err)
+			}
+			mutex.Lock()
+			switch resp.StatusCode {
+			case http.StatusOK:
+				ok++
+			case http.StatusConflict:
+				conflicts++
+			}
+			mutex.Unlock()
+		}(peer)
+	}
+	wg.Wait()
+	return ok, conflicts
+}
+
+// replicatePaste sends a new paste to the peers and zeroes its data, peers
+// that are down miss it
+func replicatePaste(paste PeerPaste) {
+	body, err := json.Marshal(paste)
+	zeroByteArray(paste.Data)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if n, _ := peerBroadcast("/peer/paste", body); n < len(CONFIGURATION.Peers) {
+		log.Printf("paste replicated to %d of %d peers", n, len(CONFIGURATION.Peers))
+	}
+	zeroByteArray(body)
+}
+
+// claimOnPeers claims a paste already claimed locally on the peers and
+// returns true if a majority of all nodes granted the claim, and whether a
+// peer refused it because the paste was claimed or deleted there
+func claimOnPeers(id string) (bool, bool) {
+	n, conflicts := peerBroadcast("/peer/claim/"+id, nil)
+	return (n+1)*2 > len(CONFIGURATION.Peers)+1, conflicts > 0
+}
+
+// restorePaste puts back a paste claimed locally whose claim failed only
+// because peers were down, so that it can be read once they are back. Peers
+// that granted the claim keep their tombstones, which is safe as a read still
+// needs a majority.
+func restorePaste(paste *Pastae) {
+	PASTAEMUTEX.Lock()
+	defer PASTAEMUTEX.Unlock()
+	if _, ok := PASTAEMAP[paste.ID]; ok {
+		return
+	}
+	delete(TOMBSTONES, paste.ID)
+	PASTAEMAP[paste.ID] = paste
+	PASTAELIST.PushBack(*paste)
+}
+
+func deleteOnPeers(pid string, hash []byte) bool {
+	n, _ := peerBroadcast("/peer/delete/"+pid, hash)
+	return n > 0
+}
+
+func peerPasteHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if r == nil {
+		log.Println("http.Request is nil")
+		return
+	}
+	defer func() {
+		ec := r.Body.Close()
+		if ec != nil {
+			log.Println(ec.Error())
+		}
+	}()
+	var paste PeerPaste
+	// base64 in JSON grows the data by a third
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, CONFIGURATION.MaxEntrySize*2+4096)).Decode(&paste)
+	if err != nil || paste.ID == "" || len(paste.ID) > 64 || strings.Contains(paste.ID, "/") ||
+		paste.ContentType == "" || int64(len(paste.Data)) > CONFIGURATION.MaxEntrySize {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	err = storeMemoryPaste(paste.ID, paste.Data, paste.BurnAfterReading, paste.ContentType, paste.Name,
+		paste.DeleteToken)
+	zeroByteArray(paste.Data)
+	if err == errTombstoned {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func peerClaimHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if r == nil {
+		log.Println("http.Request is nil")
+		return
+	}
+	defer func() {
+		ec := r.Body.Close()
+		if ec != nil {
+			log.Println(ec.Error())
+		}
+	}()
+	if !claimPaste(p.ByName("id")) {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func peerDeleteHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if r == nil {
+		log.Println("http.Request is nil")
+		return
+	}
+	defer func() {
+		ec := r.Body.Close()
+		if ec != nil {
+			log.Println(ec.Error())
+		}
+	}()
+	hash, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 64))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !deleteMemoryPaste(p.ByName("id"), hash) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
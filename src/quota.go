@@ -0,0 +1,192 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// QUOTAMUTEX serialises the quota check with the insert of a paste
+var QUOTAMUTEX sync.Mutex
+
+// QuotaUsage is the stored pastes of a user and the limits, 0 is unlimited
+type QuotaUsage struct {
+	Entries    int64
+	Bytes      int64
+	MaxEntries int64
+	MaxBytes   int64
+}
+
+// userQuota returns the usage of a user. Limits of the user override the
+// QuotaMaxEntries and QuotaMaxBytes defaults of the configuration, or the
+// PersistQuotaMaxEntries and PersistQuotaMaxBytes defaults for the
+// DatabasePersistUser holding all anonymous uploads.
+func userQuota(db queryRower, uid int64) (QuotaUsage, error) {
+	var q QuotaUsage
+	var hash string
+	var maxEntries, maxBytes sql.NullInt64
+	err := db.QueryRow("SELECT hash, quota_entries, quota_bytes FROM users WHERE id = $1", uid).Scan(
+		&hash, &maxEntries, &maxBytes)
+	if err != nil {
+		return q, err
+	}
+	q.MaxEntries = CONFIGURATION.QuotaMaxEntries
+	q.MaxBytes = CONFIGURATION.QuotaMaxBytes
+	if CONFIGURATION.DatabasePersistUser != "" && hash == CONFIGURATION.DatabasePersistUser {
+		q.MaxEntries = CONFIGURATION.PersistQuotaMaxEntries
+		q.MaxBytes = CONFIGURATION.PersistQuotaMaxBytes
+	}
+	if maxEntries.Valid {
+		q.MaxEntries = maxEntries.Int64
+	}
+	if maxBytes.Valid {
+		q.MaxBytes = maxBytes.Int64
+	}
+	err = db.QueryRow("SELECT COUNT(id), COALESCE(SUM(size),0) FROM data WHERE uid = $1", uid).Scan(&q.Entries, &q.Bytes)
+	return q, err
+}
+
+// checkQuota returns errQuotaExceeded if a paste of size bytes does not fit
+// into the quota of a user. It is run in the transaction inserting the paste
+// after lockTable, QUOTAMUTEX must be held with SQLite.
+func checkQuota(db queryRower, uid int64, size int64) error {
+	q, err := userQuota(db, uid)
+	if err != nil {
+		return err
+	}
+	if q.MaxEntries > 0 && q.Entries+1 > q.MaxEntries {
+		return errQuotaExceeded
+	}
+	if q.MaxBytes > 0 && q.Bytes+size > q.MaxBytes {
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+// setUserQuota overrides the limits of a user, an invalid value restores
+// the default of the configuration
+func setUserQuota(db *sql.DB, uid int64, maxEntries sql.NullInt64, maxBytes sql.NullInt64) (bool, error) {
+	if (maxEntries.Valid && maxEntries.Int64 < 0) || (maxBytes.Valid && maxBytes.Int64 < 0) {
+		return false, errors.New("negative quota")
+	}
+	return execAffected(db, "UPDATE users SET quota_entries = $1, quota_bytes = $2 WHERE id = $3",
+		maxEntries, maxBytes, uid)
+}
+
+// setQuotaHeaders exposes the usage of a user in pastae-usage-* and
+// pastae-quota-* response headers
+func setQuotaHeaders(w http.ResponseWriter, q QuotaUsage) {
+	w.Header().Set("pastae-usage-entries", strconv.FormatInt(q.Entries, 10))
+	w.Header().Set("pastae-usage-bytes", strconv.FormatInt(q.Bytes, 10))
+	w.Header().Set("pastae-quota-entries", strconv.FormatInt(q.MaxEntries, 10))
+	w.Header().Set("pastae-quota-bytes", strconv.FormatInt(q.MaxBytes, 10))
+}
+
+// migratePasteSizes fills in the size of pastes stored by older versions
+// from the data file size without the GCM tag. A paste whose file is gone has
+// size 0, other errors fail the migration so that it runs again.
+func migratePasteSizes(tx *sql.Tx) error {
+	res, err := tx.Query("SELECT id, fname FROM data WHERE size IS NULL")
+	if err != nil {
+		return err
+	}
+	fnames := make(map[int64]string)
+	for res.Next() {
+		var id int64
+		var fname string
+		err = res.Scan(&id, &fname)
+		if err != nil {
+			ec := res.Close()
+			if ec != nil {
+				log.Println(ec.Error())
+			}
+			return err
+		}
+		fnames[id] = fname
+	}
+	err = res.Close()
+	if err != nil {
+		return err
+	}
+	for id, fname := range fnames {
+		size, err := BLOBS.Size(fname)
+		if errors.Is(err, os.ErrNotExist) {
+			log.Println(err)
+		} else if err != nil {
+			return err
+		}
+		size = max(size-16, 0)
+		_, err = tx.Exec("UPDATE data SET size = $1 WHERE id = $2", size, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// quotaForm parses an optional non-negative form field, empty is no value
+func quotaForm(r *http.Request, name string) (sql.NullInt64, error) {
+	v := r.PostFormValue(name)
+	if v == "" {
+		return sql.NullInt64{}, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return sql.NullInt64{}, errors.New("invalid quota " + name)
+	}
+	return sql.NullInt64{Int64: n, Valid: true}, nil
+}
+
+// setQuotaHandler reads form fields entries and bytes, 0 is unlimited and
+// an empty field restores the default
+func setQuotaHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer func() {
+		ec := r.Body.Close()
+		if ec != nil {
+			log.Println(ec.Error())
+		}
+	}()
+	if _, ok := adminSession(w, r); !ok {
+		return
+	}
+	id, err := strconv.ParseInt(p.ByName("id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 4096)
+	err = r.ParseMultipartForm(4096)
+	if err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	maxEntries, err := quotaForm(r, "entries")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	maxBytes, err := quotaForm(r, "bytes")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	ok, err := setUserQuota(DB, id, maxEntries, maxBytes)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"container/list"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// LoginAttempts tracks failed logins of a client address or an account
+type LoginAttempts struct {
+	Failures    int
+	LastFailure int64
+	LockedUntil int64
+	elem        *list.Element
+}
+
+// At most loginAttemptsMax keys are tracked in memory, as usernames are chosen
+// by the client. The least recently failed key is forgotten first.
+const loginAttemptsMax int = 65536
+
+var LOGINATTEMPTS = make(map[string]*LoginAttempts)
+var LOGINLIST = list.New()
+var LOGINMUTEX sync.Mutex
+
+func clientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// loginKeys returns the attempt tracking keys of a login to username
+func loginKeys(r *http.Request, username string) []string {
+	return []string{"ip:" + clientAddress(r), "user:" + username}
+}
+
+func registerKeys(r *http.Request) []string {
+	return []string{"register:" + clientAddress(r)}
+}
+
+// loginLocked returns the seconds until none of keys is locked out
+func loginLocked(keys ...string) int64 {
+	if CONFIGURATION.LoginMaxAttempts <= 0 {
+		return 0
+	}
+	if sharedState() {
+		return sharedLoginLocked(keys...)
+	}
+	now := time.Now().Unix()
+	var wait int64 = 0
+	LOGINMUTEX.Lock()
+	defer LOGINMUTEX.Unlock()
+	for _, key := range keys {
+		a, ok := LOGINATTEMPTS[key]
+		if ok && a.LockedUntil-now > wait {
+			wait = a.LockedUntil - now
+		}
+	}
+	return wait
+}
+
+// loginFailed records a failed attempt. After LoginMaxAttempts failures each
+// further failure locks the key out for exponentially longer, at most
+// LoginLockout seconds. Failures are forgotten after LoginLockout seconds.
+func loginFailed(keys ...string) {
+	if CONFIGURATION.LoginMaxAttempts <= 0 {
+		return
+	}
+	if sharedState() {
+		sharedLoginFailed(keys...)
+		return
+	}
+	now := time.Now().Unix()
+	LOGINMUTEX.Lock()
+	defer LOGINMUTEX.Unlock()
+	for _, key := range keys {
+		a, ok := LOGINATTEMPTS[key]
+		if !ok {
+			a = &LoginAttempts{elem: LOGINLIST.PushBack(key)}
+			LOGINATTEMPTS[key] = a
+			for LOGINLIST.Len() > loginAttemptsMax {
+				removeLoginAttempts(LOGINLIST.Front().Value.(string))
+			}
+		} else if a.LastFailure <= now-CONFIGURATION.LoginLockout {
+			a.Failures = 0
+			a.LockedUntil = 0
+		}
+		LOGINLIST.MoveToBack(a.elem)
+		a.Failures++
+		a.LastFailure = now
+		if lock := loginLockDuration(a.Failures); lock > 0 {
+			a.LockedUntil = now + lock
+		}
+	}
+}
+
+// loginLockDuration returns the lockout in seconds after failures
+func loginLockDuration(failures int) int64 {
+	over := failures - CONFIGURATION.LoginMaxAttempts
+	if over <= 0 {
+		return 0
+	}
+	lock := CONFIGURATION.LoginBackoff << min(over-1, 30)
+	if CONFIGURATION.LoginLockout > 0 && lock > CONFIGURATION.LoginLockout {
+		lock = CONFIGURATION.LoginLockout
+	}
+	return lock
+}
+
+func loginSucceeded(keys ...string) {
+	if sharedState() {
+		sharedLoginSucceeded(keys...)
+		return
+	}
+	LOGINMUTEX.Lock()
+	defer LOGINMUTEX.Unlock()
+	for _, key := range keys {
+		removeLoginAttempts(key)
+	}
+}
+
+// removeLoginAttempts forgets a key, LOGINMUTEX must be held
+func removeLoginAttempts(key string) {
+	a, ok := LOGINATTEMPTS[key]
+	if !ok {
+		return
+	}
+	LOGINLIST.Remove(a.elem)
+	delete(LOGINATTEMPTS, key)
+}
+
+func cleanLoginAttempts() {
+	if sharedState() {
+		sharedCleanLoginAttempts()
+		return
+	}
+	now := time.Now().Unix()
+	LOGINMUTEX.Lock()
+	defer LOGINMUTEX.Unlock()
+	for key, a := range LOGINATTEMPTS {
+		if a.LockedUntil <= now && a.LastFailure <= now-CONFIGURATION.LoginLockout {
+			removeLoginAttempts(key)
+		}
+	}
+}
+
+func tooManyRequests(w http.ResponseWriter, wait int64) {
+	w.Header().Set("Retry-After", strconv.FormatInt(wait, 10))
+	w.WriteHeader(http.StatusTooManyRequests)
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Registration modes, an empty mode is open registration
+const registrationOpen string = "open"
+const registrationInvite string = "invite"
+const registrationApproval string = "approval"
+const registrationClosed string = "closed"
+
+var errPendingApproval = errors.New("account is pending approval")
+var errRegistrationClosed = errors.New("registration is closed")
+var errInvalidInvite = errors.New("invalid invite code")
+
+type InviteListing struct {
+	ID      int64
+	MaxUses int64
+	Uses    int64
+	Created int64
+	Expire  int64
+}
+
+type PendingUser struct {
+	ID       int64
+	Username string
+}
+
+// registerWithMode creates an account as allowed by RegistrationMode and
+// tells whether it needs approval. A valid invite code allows registration
+// in every mode but closed and skips approval.
+func registerWithMode(db *sql.DB, username string, password string, invite string) (bool, error) {
+	mode := CONFIGURATION.RegistrationMode
+	if !slices.Contains([]string{"", registrationOpen, registrationInvite, registrationApproval}, mode) {
+		return false, errRegistrationClosed
+	}
+	if invite != "" {
+		id, err := redeemInvite(db, invite)
+		if err != nil {
+			return false, err
+		}
+		err = createAccount(db, username, password, false)
+		if err != nil {
+			refundInvite(db, id)
+		}
+		return false, err
+	}
+	switch mode {
+	case registrationInvite:
+		return false, errInvalidInvite
+	case registrationApproval:
+		return true, createAccount(db, username, password, true)
+	}
+	return false, createAccount(db, username, password, false)
+}
+
+// createInvite returns a new invite code usable maxUses times, stored hashed
+func createInvite(db *sql.DB, createdBy int64, maxUses int64, days int64) (string, error) {
+	if maxUses < 1 || days < 0 {
+		return "", errors.New("invalid invite uses or expiry")
+	}
+	rnd, err := generateRandomBytes(16)
+	if err != nil {
+		return "", err
+	}
+	code := hex.EncodeToString(rnd)
+	now := time.Now().Unix()
+	var expire sql.NullInt64
+	if days > 0 {
+		expire = sql.NullInt64{Int64: now + days*24*60*60, Valid: true}
+	}
+	_, err = db.Exec("INSERT INTO invites (code, max_uses, created, expire, created_by) VALUES ($1, $2, $3, $4, $5)",
+		tokenHash(code), maxUses, now, expire, createdBy)
+	if err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+func redeemInvite(db *sql.DB, code string) (int64, error) {
+	var id int64
+	err := db.QueryRow("UPDATE invites SET uses = uses + 1 WHERE code = $1 AND uses < max_uses AND "+
+		"(expire IS NULL OR expire > $2) RETURNING id", tokenHash(code), time.Now().Unix()).Scan(&id)
+	if err != nil {
+		return 0, errInvalidInvite
+	}
+	return id, nil
+}
+
+// refundInvite gives back a use of an invite when registration failed
+func refundInvite(db *sql.DB, id int64) {
+	_, err := db.Exec("UPDATE invites SET uses = uses - 1 WHERE id = $1 AND uses > 0", id)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func listInvites(db *sql.DB) ([]InviteListing, error) {
+	res, err := db.Query("SELECT id, max_uses, uses, created, COALESCE(expire,0) FROM invites ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		ec := res.Close()
+		if ec != nil {
+			log.Println(ec.Error())
+		}
+	}()
+	invites := []InviteListing{}
+	for res.Next() {
+		var elem InviteListing
+		err = res.Scan(&elem.ID, &elem.MaxUses, &elem.Uses, &elem.Created, &elem.Expire)
+		if err != nil {
+			return nil, err
+		}
+		invites = append(invites, elem)
+	}
+	return invites, res.Err()
+}
+
+func deleteInvite(db *sql.DB, id int64) (bool, error) {
+	return execAffected(db, "DELETE FROM invites WHERE id = $1", id)
+}
+
+func listPendingUsers(db *sql.DB) ([]PendingUser, error) {
+	res, err := db.Query("SELECT id, COALESCE(username, hash) FROM users WHERE pending = 1 ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		ec := res.Close()
+		if ec != nil {
+			log.Println(ec.Error())
+		}
+	}()
+	users := []PendingUser{}
+	for res.Next() {
+		var elem PendingUser
+		err = res.Scan(&elem.ID, &elem.Username)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, elem)
+	}
+	return users, res.Err()
+}
+
+func approveUser(db *sql.DB, id int64) (bool, error) {
+	return execAffected(db, "UPDATE users SET pending = 0 WHERE id = $1 AND pending = 1", id)
+}
+
+// rejectUser deletes a pending user, which can not have pastes yet
+func rejectUser(db *sql.DB, id int64) (bool, error) {
+	return execAffected(db, "DELETE FROM users WHERE id = $1 AND pending = 1", id)
+}
+
+func execAffected(db *sql.DB, query string, args ...any) (bool, error) {
+	res, err := db.Exec(query, args...)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// isAdmin tells whether a user is listed in Admins of the configuration
+func isAdmin(db *sql.DB, uid int64) bool {
+	var username sql.NullString
+	err := db.QueryRow("SELECT username FROM users WHERE id = $1", uid).Scan(&username)
+	if err != nil || !username.Valid {
+		return false
+	}
+	return slices.Contains(CONFIGURATION.Admins, username.String)
+}
+
+// adminSession writes an error response and returns false unless the request
+// has a session of an admin
+func adminSession(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	uid, _, err := sessionValid(DB, sessionToken(r), scopeSession)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return 0, false
+	}
+	if !isAdmin(DB, uid) {
+		w.WriteHeader(http.StatusForbidden)
+		return 0, false
+	}
+	return uid, true
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	_, err = w.Write(bytes)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+func invitesHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer func() {
+		ec := r.Body.Close()
+		if ec != nil {
+			log.Println(ec.Error())
+		}
+	}()
+	if _, ok := adminSession(w, r); !ok {
+		return
+	}
+	invites, err := listInvites(DB)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, invites)
+}
+
+// createInviteHandler reads optional form fields uses (1) and expire in days
+// and responds with the invite code
+func createInviteHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer func() {
+		ec := r.Body.Close()
+		if ec != nil {
+			log.Println(ec.Error())
+		}
+	}()
+	uid, ok := adminSession(w, r)
+	if !ok {
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 4096)
+	err := r.ParseMultipartForm(4096)
+	if err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var uses int64 = 1
+	var days int64 = 0
+	if u := r.PostFormValue("uses"); u != "" {
+		uses, err = strconv.ParseInt(u, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if e := r.PostFormValue("expire"); e != "" {
+		days, err = strconv.ParseInt(e, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	code, err := createInvite(DB, uid, uses, days)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	_, err = w.Write([]byte(code))
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// adminIDHandler returns a handler running action on the id parameter
+func adminIDHandler(action func(*sql.DB, int64) (bool, error)) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		defer func() {
+			ec := r.Body.Close()
+			if ec != nil {
+				log.Println(ec.Error())
+			}
+		}()
+		if _, ok := adminSession(w, r); !ok {
+			return
+		}
+		id, err := strconv.ParseInt(p.ByName("id"), 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		ok, err := action(DB, id)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func pendingUsersHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer func() {
+		ec := r.Body.Close()
+		if ec != nil {
+			log.Println(ec.Error())
+		}
+	}()
+	if _, ok := adminSession(w, r); !ok {
+		return
+	}
+	users, err := listPendingUsers(DB)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, users)
+}
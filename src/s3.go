@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Blobs larger than s3PartSize are uploaded in parts, S3 needs parts of at
+// least 5 MiB but the last
+const s3PartSize int = 8 << 20
+
+// S3Store keeps blobs in a bucket of an S3 compatible object store, addressed
+// path style as S3Endpoint/S3Bucket/S3Prefix+name
+type S3Store struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	PartSize  int
+	HTTP      *http.Client
+}
+
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+type s3InitiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+type s3ListBucketResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func newS3Store() (*S3Store, error) {
+	if CONFIGURATION.S3Endpoint == "" || CONFIGURATION.S3Bucket == "" {
+		return nil, errors.New("s3Endpoint and s3Bucket are required")
+	}
+	region := CONFIGURATION.S3Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &S3Store{Endpoint: strings.TrimSuffix(CONFIGURATION.S3Endpoint, "/"), Region: region,
+		Bucket: CONFIGURATION.S3Bucket, Prefix: CONFIGURATION.S3Prefix, AccessKey: CONFIGURATION.S3AccessKey,
+		SecretKey: CONFIGURATION.S3SecretKey, PartSize: s3PartSize, HTTP: &http.Client{Timeout: 60 * time.Second}}, nil
+}
+
+func (s *S3Store) Put(name string, data []byte) error {
+	if len(data) > s.PartSize {
+		return s.putMultipart(name, data)
+	}
+	_, err := s.do(http.MethodPut, name, nil, data)
+	return err
+}
+
+func (s *S3Store) Get(name string) ([]byte, error) {
+	return s.do(http.MethodGet, name, nil, nil)
+}
+
+// Size returns the length of an object from a HEAD request
+func (s *S3Store) Size(name string) (int64, error) {
+	req, err := s.newRequest(http.MethodHead, s.Prefix+name, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := s.send(req)
+	if err != nil {
+		return 0, err
+	}
+	if resp.ContentLength < 0 {
+		return 0, errors.New("s3: HEAD " + req.URL.Path + ": no Content-Length")
+	}
+	return resp.ContentLength, nil
+}
+
+func (s *S3Store) Delete(name string) error {
+	_, err := s.do(http.MethodDelete, name, nil, nil)
+	return err
+}
+
+// List returns the names of the objects under Prefix
+func (s *S3Store) List() ([]BlobInfo, error) {
+	var blobs []BlobInfo
+	query := url.Values{"list-type": {"2"}, "prefix": {s.Prefix}}
+	for {
+		resp, err := s.request(http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result s3ListBucketResult
+		err = xml.Unmarshal(resp, &result)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range result.Contents {
+			blobs = append(blobs, BlobInfo{Name: strings.TrimPrefix(c.Key, s.Prefix), Modified: c.LastModified})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return blobs, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// putMultipart uploads data in parts and aborts the upload on failure so
+// that no parts are left stored
+func (s *S3Store) putMultipart(name string, data []byte) error {
+	resp, err := s.do(http.MethodPost, name, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return err
+	}
+	var initiated s3InitiateMultipartUploadResult
+	err = xml.Unmarshal(resp, &initiated)
+	if err != nil {
+		return err
+	}
+	if initiated.UploadID == "" {
+		return errors.New("s3: no upload id")
+	}
+	complete := s3CompleteMultipartUpload{}
+	for part := 1; len(data) > 0; part++ {
+		n := min(len(data), s.PartSize)
+		var etag string
+		etag, err = s.putPart(name, initiated.UploadID, part, data[:n])
+		if err != nil {
+			break
+		}
+		complete.Parts = append(complete.Parts, s3CompletedPart{PartNumber: part, ETag: etag})
+		data = data[n:]
+	}
+	var body []byte
+	if err == nil {
+		body, err = xml.Marshal(complete)
+	}
+	if err == nil {
+		_, err = s.do(http.MethodPost, name, url.Values{"uploadId": {initiated.UploadID}}, body)
+	}
+	if err != nil {
+		_, ec := s.do(http.MethodDelete, name, url.Values{"uploadId": {initiated.UploadID}}, nil)
+		if ec != nil {
+			return fmt.Errorf("%w, aborting upload failed: %v", err, ec)
+		}
+	}
+	return err
+}
+
+func (s *S3Store) putPart(name string, uploadID string, part int, data []byte) (string, error) {
+	query := url.Values{"partNumber": {strconv.Itoa(part)}, "uploadId": {uploadID}}
+	req, err := s.newRequest(http.MethodPut, name, query, data)
+	if err != nil {
+		return "", err
+	}
+	resp, err := s.send(req)
+	if err != nil {
+		return "", err
+	}
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		return "", errors.New("s3: no ETag for part " + strconv.Itoa(part))
+	}
+	return etag, nil
+}
+
+func (s *S3Store) do(method string, name string, query url.Values, body []byte) ([]byte, error) {
+	return s.request(method, s.Prefix+name, query, body)
+}
+
+func (s *S3Store) request(method string, key string, query url.Values, body []byte) ([]byte, error) {
+	req, err := s.newRequest(method, key, query, body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.send(req)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (s *S3Store) newRequest(method string, key string, query url.Values, body []byte) (*http.Request, error) {
+	u := s.Endpoint + "/" + s3Escape(s.Bucket)
+	if key != "" {
+		u += "/" + s3Escape(key)
+	}
+	if len(query) > 0 {
+		u += "?" + s3Query(query)
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	s3Sign(req, body, s.AccessKey, s.SecretKey, s.Region, time.Now())
+	return req, nil
+}
+
+// send performs a request and returns the response with a body buffered in
+// memory, or an error for other than 2xx responses
+func (s *S3Store) send(req *http.Request) (*http.Response, error) {
+	resp, err := s.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(resp.Body)
+	ec := resp.Body.Close()
+	if err == nil {
+		err = ec
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		status := resp.Status
+		var e s3Error
+		if xml.Unmarshal(data, &e) == nil && e.Code != "" {
+			status = e.Code + " " + e.Message
+		}
+		// a missing object is reported like a missing file
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("s3: %s %s: %s: %w", req.Method, req.URL.Path, status, os.ErrNotExist)
+		}
+		return nil, fmt.Errorf("s3: %s %s: %s", req.Method, req.URL.Path, status)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	return resp, nil
+}
+
+// s3Escape encodes a key as S3 expects it in the path, keeping slashes
+func s3Escape(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = s3EscapeComponent(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// s3EscapeComponent encodes all but the unreserved characters of RFC 3986
+func s3EscapeComponent(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Query encodes a query sorted by name as needed for signing
+func s3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		values := append([]string{}, query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, s3EscapeComponent(k)+"="+s3EscapeComponent(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Sign adds AWS Signature Version 4 headers to a request. Host, Range,
+// Content-Type, Content-MD5 and x-amz-* headers are signed.
+func s3Sign(req *http.Request, body []byte, accessKey string, secretKey string, region string, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102")
+	payload := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(payload[:])
+	req.Header.Set("x-amz-date", now.Format("20060102T150405Z"))
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "range" || name == "content-type" || name == "content-md5" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{req.Method, path, s3Query(req.URL.Query()),
+		canonicalHeaders.String(), signedHeaders, payloadHash}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" +
+		hex.EncodeToString(requestHash[:])
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
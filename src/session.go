@@ -1,41 +1,73 @@
 package main
 
 import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
 	"database/sql"
+	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
 )
 
+// Cookies of browser sessions
+const sessionCookie string = "pastae-session"
+const csrfCookie string = "pastae-csrf"
+
 type Session struct {
-	UserID  int64
-	Kek     []byte
-	Created int64
+	UserID    int64
+	Kek       []byte
+	Created   int64
+	LastSeen  int64
+	UserAgent string
 }
 
-func sessionCleaner(sleepTime time.Duration) {
+func sessionCleaner(db *sql.DB, sleepTime time.Duration) {
+	if db == nil {
+		return
+	}
 	for {
 		time.Sleep(sleepTime)
-		cleanSessions()
+		cleanSessions(db)
+		cleanApiTokens(db)
+		cleanLoginAttempts()
 	}
 }
 
-func cleanSessions() {
-	SESSIONMUTEX.Lock()
-	defer SESSIONMUTEX.Unlock()
-	for k, v := range SESSIONS {
-		if time.Now().Unix()-v.Created >= CONFIGURATION.DatabaseTimeout {
-			delete(SESSIONS, k)
-		}
+func cleanSessions(db *sql.DB) {
+	if db == nil {
+		return
+	}
+	idle, absolute := sessionLimits()
+	_, err := db.Exec("DELETE FROM sessions WHERE last_seen <= $1 OR created <= $2", idle, absolute)
+	if err != nil {
+		log.Println(err)
 	}
 }
 
+// sessionLimits returns the oldest accepted last seen and creation times.
+// DatabaseTimeout is the idle timeout and DatabaseSessionLifetime the absolute
+// lifetime of a session regardless of activity.
+func sessionLimits() (int64, int64) {
+	now := time.Now().Unix()
+	var absolute int64 = 0
+	if CONFIGURATION.DatabaseSessionLifetime > 0 {
+		absolute = now - CONFIGURATION.DatabaseSessionLifetime
+	}
+	return now - CONFIGURATION.DatabaseTimeout, absolute
+}
+
 func expiredCleaner(db *sql.DB, sleepTime time.Duration) {
 	if db == nil {
 		return
@@ -43,6 +75,12 @@ func expiredCleaner(db *sql.DB, sleepTime time.Duration) {
 	for {
 		time.Sleep(sleepTime)
 		cleanExpired(db)
+		if sharedState() {
+			err := refreshPasteCount(db)
+			if err != nil {
+				log.Println(err)
+			}
+		}
 	}
 }
 
@@ -50,42 +88,28 @@ func cleanExpired(db *sql.DB) {
 	if db == nil {
 		return
 	}
-	r, err := db.Query("DELETE FROM data WHERE expire IS NOT NULL AND expire <= $1 RETURNING fname",
+	_, err := deleteDataRows(db, "DELETE FROM data WHERE expire IS NOT NULL AND expire <= $1 RETURNING fname",
 		time.Now().Unix())
 	if err != nil {
-		ec := r.Close()
-		if ec != nil {
-			log.Println(ec.Error())
-		}
 		log.Println(err)
-		return
-	}
-	defer func() {
-		ec := r.Close()
-		if ec != nil {
-			log.Println(ec.Error())
-		}
-	}()
-	for r.Next() {
-		SESSIONPASTECOUNT.Add(-1)
-		var fname string
-		err = r.Scan(&fname)
-		if err != nil {
-			log.Println(err)
-			continue
-		}
-		err = os.Remove(CONFIGURATION.DataPath + fname)
-		if err != nil {
-			log.Println(err)
-		}
 	}
 }
 
-func sessionValid(db *sql.DB, token string) (int64, []byte, error) {
+// sessionValid returns the user and KEK of a session. API tokens are accepted
+// instead of a session ID for operations of their scopes.
+func sessionValid(db *sql.DB, token string, scope string) (int64, []byte, error) {
 	if db == nil {
 		return -100, []byte("nil db"), errors.New("nil db")
 	}
-	if token == "" && CONFIGURATION.DatabasePersistUser != "" {
+	if strings.HasPrefix(token, apiTokenPrefix) {
+		if scope == scopeSession {
+			return -100, []byte("Invalid session"), errors.New("sessionValid")
+		}
+		return apiTokenValid(db, token, scope)
+	}
+	// Anonymous uploads are persisted as DatabasePersistUser, nothing else
+	// may act as that user without a session
+	if token == "" && scope == scopeUpload && CONFIGURATION.DatabasePersistUser != "" {
 		var uid int64
 		var kek []byte
 		err := db.QueryRow("SELECT id, kek FROM users WHERE hash = $1",
@@ -95,13 +119,149 @@ func sessionValid(db *sql.DB, token string) (int64, []byte, error) {
 		}
 		return uid, kek, nil
 	}
-	SESSIONMUTEX.RLock()
-	defer SESSIONMUTEX.RUnlock()
-	ses, ok := SESSIONS[token]
-	if !ok {
+	if token == "" {
 		return -100, []byte("Invalid session"), errors.New("sessionValid")
 	}
-	return ses.UserID, ses.Kek, nil
+	var uid int64
+	var wrapped []byte
+	var nonce []byte
+	idle, absolute := sessionLimits()
+	err := db.QueryRow("UPDATE sessions SET last_seen = $1 WHERE token = $2 AND last_seen > $3 AND created > $4 "+
+		"RETURNING uid, kek, nonce", time.Now().Unix(), tokenHash(token), idle, absolute).Scan(&uid, &wrapped, &nonce)
+	if err != nil {
+		return -100, []byte("Invalid session"), errors.New("sessionValid")
+	}
+	key := tokenKey(token)
+	kek, err := decrypt(wrapped, key, nonce)
+	zeroByteArray(key)
+	if err != nil {
+		return -100, []byte("Invalid session"), errors.New("sessionValid")
+	}
+	return uid, kek, nil
+}
+
+type SessionListing struct {
+	ID        int64
+	Created   int64
+	LastSeen  int64
+	UserAgent string
+	Current   bool
+}
+
+// listSessions returns the active sessions of a user, token marks the current one
+func listSessions(db *sql.DB, uid int64, token string) ([]SessionListing, error) {
+	idle, absolute := sessionLimits()
+	res, err := db.Query("SELECT id, created, last_seen, COALESCE(user_agent,''), token = $1 FROM sessions "+
+		"WHERE uid = $2 AND last_seen > $3 AND created > $4 ORDER BY id", tokenHash(token), uid, idle, absolute)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		ec := res.Close()
+		if ec != nil {
+			log.Println(ec.Error())
+		}
+	}()
+	sessions := []SessionListing{}
+	for res.Next() {
+		var elem SessionListing
+		err = res.Scan(&elem.ID, &elem.Created, &elem.LastSeen, &elem.UserAgent, &elem.Current)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, elem)
+	}
+	return sessions, res.Err()
+}
+
+func revokeSession(db *sql.DB, uid int64, id int64) (bool, error) {
+	res, err := db.Exec("DELETE FROM sessions WHERE id = $1 AND uid = $2", id, uid)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func sessionsHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if r == nil {
+		log.Println("http.Request is nil")
+		return
+	}
+	defer func() {
+		ec := r.Body.Close()
+		if ec != nil {
+			log.Println(ec.Error())
+		}
+	}()
+	sessid := sessionToken(r)
+	if sessid == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	uid, _, err := sessionValid(DB, sessid, scopeSession)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	sessions, err := listSessions(DB, uid, sessid)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	bytes, err := json.Marshal(sessions)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	_, err = w.Write(bytes)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+func revokeSessionHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if r == nil {
+		log.Println("http.Request is nil")
+		return
+	}
+	defer func() {
+		ec := r.Body.Close()
+		if ec != nil {
+			log.Println(ec.Error())
+		}
+	}()
+	sessid := sessionToken(r)
+	if sessid == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	uid, _, err := sessionValid(DB, sessid, scopeSession)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	id, err := strconv.ParseInt(p.ByName("id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	ok, err := revokeSession(DB, uid, id)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
 }
 
 func registerUser(db *sql.DB, hash string) error {
@@ -122,7 +282,386 @@ func registerUser(db *sql.DB, hash string) error {
 	return nil
 }
 
-func loginHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+// registerAccount creates a user with a username and an Argon2id hashed password
+func registerAccount(db *sql.DB, username string, password string) error {
+	return createAccount(db, username, password, false)
+}
+
+// createAccount creates a user, pending users can not log in until approved
+func createAccount(db *sql.DB, username string, password string, pending bool) error {
+	if db == nil {
+		return errors.New("nil db")
+	}
+	if !validUsername(username) {
+		return errors.New("invalid username")
+	}
+	if len(password) < 8 || len(password) > 1024 {
+		return errors.New("password must be 8-1024 bytes")
+	}
+	encoded, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	kek, err := generateRandomBytes(64)
+	if err != nil {
+		return err
+	}
+	wrapped, salt, nonce, err := wrapUserKek(kek, password, encoded)
+	zeroByteArray(kek)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT INTO users (hash, kek, kek_salt, kek_nonce, username, password, pending) "+
+		"VALUES ($1, $2, $3, $4, $5, $6, $7)", "user:"+username, wrapped, salt, nonce, username, encoded, boolInt(pending))
+	return err
+}
+
+// wrapUserKek encrypts a user KEK with a key derived from the user's password
+// so that the database alone is not enough to decrypt the user's pastes
+func wrapUserKek(kek []byte, password string, encoded string) ([]byte, []byte, []byte, error) {
+	salt, err := generateRandomBytes(16)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	nonce, err := generateRandomBytes(12)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	key, err := kekWrapKey(password, salt, encoded)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	wrapped, err := encrypt(kek, key, nonce)
+	zeroByteArray(key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return wrapped, salt, nonce, nil
+}
+
+func unwrapUserKek(wrapped []byte, salt []byte, nonce []byte, password string, encoded string) ([]byte, error) {
+	key, err := kekWrapKey(password, salt, encoded)
+	if err != nil {
+		return nil, err
+	}
+	kek, err := decrypt(wrapped, key, nonce)
+	zeroByteArray(key)
+	if err != nil {
+		return nil, err
+	}
+	return kek, nil
+}
+
+// changePassword replaces the password of a user and re-wraps the KEK with
+// the new password, pastes are not re-encrypted
+func changePassword(db *sql.DB, uid int64, password string, newPassword string) error {
+	if db == nil {
+		return errors.New("nil db")
+	}
+	if len(newPassword) < 8 || len(newPassword) > 1024 {
+		return errors.New("password must be 8-1024 bytes")
+	}
+	var kek, salt, nonce []byte
+	var encoded string
+	err := db.QueryRow("SELECT kek, kek_salt, kek_nonce, password FROM users WHERE id = $1 AND password IS NOT NULL",
+		uid).Scan(&kek, &salt, &nonce, &encoded)
+	if err != nil {
+		return err
+	}
+	ok, err := verifyPassword(password, encoded)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("invalid password")
+	}
+	if nonce != nil {
+		kek, err = unwrapUserKek(kek, salt, nonce, password, encoded)
+		if err != nil {
+			return err
+		}
+	}
+	newEncoded, err := hashPassword(newPassword)
+	if err != nil {
+		return err
+	}
+	wrapped, salt, nonce, err := wrapUserKek(kek, newPassword, newEncoded)
+	zeroByteArray(kek)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE users SET password = $1, kek = $2, kek_salt = $3, kek_nonce = $4 WHERE id = $5",
+		newEncoded, wrapped, salt, nonce, uid)
+	return err
+}
+
+func validUsername(username string) bool {
+	if len(username) == 0 || len(username) > 64 {
+		return false
+	}
+	for _, c := range username {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+			c == '.' || c == '_' || c == '-' || c == '@') {
+			return false
+		}
+	}
+	return true
+}
+
+// authenticate verifies username and password and returns the user ID and KEK.
+// Users registered with the old client side hash are upgraded to Argon2id on
+// their first login.
+func authenticate(db *sql.DB, username string, password string) (int64, []byte, error) {
+	if db == nil {
+		return -100, nil, errors.New("nil db")
+	}
+	var uid int64
+	var kek, salt, nonce []byte
+	var encoded string
+	var pending bool
+	err := db.QueryRow("SELECT id, kek, kek_salt, kek_nonce, password, pending FROM users "+
+		"WHERE username = $1 AND password IS NOT NULL", username).Scan(&uid, &kek, &salt, &nonce, &encoded, &pending)
+	if errors.Is(err, sql.ErrNoRows) {
+		return authenticateLegacy(db, username, password)
+	}
+	if err != nil {
+		return -100, nil, err
+	}
+	ok, err := verifyPassword(password, encoded)
+	if err != nil {
+		return -100, nil, err
+	}
+	if !ok {
+		return -100, nil, errors.New("invalid password")
+	}
+	if pending {
+		return -100, nil, errPendingApproval
+	}
+	if nonce == nil {
+		err = storeWrappedKek(db, uid, kek, password, encoded)
+		if err != nil {
+			return -100, nil, err
+		}
+		return uid, kek, nil
+	}
+	kek, err = unwrapUserKek(kek, salt, nonce, password, encoded)
+	if err != nil {
+		return -100, nil, err
+	}
+	return uid, kek, nil
+}
+
+// storeWrappedKek replaces a KEK stored in plaintext by older versions
+func storeWrappedKek(db *sql.DB, uid int64, kek []byte, password string, encoded string) error {
+	wrapped, salt, nonce, err := wrapUserKek(kek, password, encoded)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE users SET kek = $1, kek_salt = $2, kek_nonce = $3 WHERE id = $4",
+		wrapped, salt, nonce, uid)
+	return err
+}
+
+func authenticateLegacy(db *sql.DB, username string, password string) (int64, []byte, error) {
+	// Hash the password even when no user matches to not reveal which usernames exist
+	encoded, err := hashPassword(password)
+	if err != nil {
+		return -100, nil, err
+	}
+	hash := legacyHash(username, password)
+	if !validUsername(username) || len(password) == 0 || hash == CONFIGURATION.DatabasePersistUser {
+		return -100, nil, errors.New("invalid user")
+	}
+	var uid int64
+	var kek []byte
+	err = db.QueryRow("SELECT id, kek FROM users WHERE password IS NULL AND (hash = $1 OR hash = $2)",
+		hash, legacyKey(hash)).Scan(&uid, &kek)
+	if err != nil {
+		return -100, nil, errors.New("invalid user")
+	}
+	_, err = db.Exec("UPDATE users SET hash = $1, username = $2, password = $3 WHERE id = $4",
+		"user:"+username, username, encoded, uid)
+	if err != nil {
+		return -100, nil, err
+	}
+	err = storeWrappedKek(db, uid, kek, password, encoded)
+	if err != nil {
+		return -100, nil, err
+	}
+	return uid, kek, nil
+}
+
+// legacyHash is the hash that the web client used to send in place of a password
+func legacyHash(username string, password string) string {
+	h1 := sha512.Sum512([]byte(username + "FpF97vqSEMvfTWtMtwg27tGduc667XyCSfJKy4pZhRLmDsyMUsBbqQbbJEBbWyu6" + password))
+	h2 := sha256.Sum256(h1[:])
+	h3 := sha512.Sum512(h2[:])
+	return base64.StdEncoding.EncodeToString(h3[:])
+}
+
+func legacyKey(hash string) string {
+	return "legacy:" + hex.EncodeToString(tokenHash(hash))
+}
+
+// migrateLegacyUsers replaces hashes stored verbatim by old versions so that a
+// copy of the users table cannot be used to log in
+func migrateLegacyUsers(tx *sql.Tx) error {
+	res, err := tx.Query("SELECT id, hash FROM users WHERE password IS NULL AND hash NOT LIKE 'legacy:%' AND "+
+		"hash NOT LIKE 'user:%' AND hash NOT LIKE 'oidc:%' AND hash != $1", CONFIGURATION.DatabasePersistUser)
+	if err != nil {
+		return err
+	}
+	hashes := make(map[int64]string)
+	for res.Next() {
+		var id int64
+		var hash string
+		err = res.Scan(&id, &hash)
+		if err != nil {
+			ec := res.Close()
+			if ec != nil {
+				log.Println(ec.Error())
+			}
+			return err
+		}
+		hashes[id] = hash
+	}
+	err = res.Close()
+	if err != nil {
+		return err
+	}
+	for id, hash := range hashes {
+		_, err = tx.Exec("UPDATE users SET hash = $1 WHERE id = $2", legacyKey(hash), id)
+		if err != nil {
+			return err
+		}
+	}
+	if len(hashes) > 0 {
+		log.Printf("Migrated %d legacy users", len(hashes))
+	}
+	return nil
+}
+
+// migrateLegacyPastes re-encrypts pastes stored by older versions with the
+// owner KEK so that they are encrypted with a key derived from the paste ID.
+// This must run before user KEKs get wrapped on login. The new files are
+// written only when not in a dry run and the old ones are returned for removal
+// after commit.
+func migrateLegacyPastes(tx *sql.Tx, dryRun bool) ([]string, error) {
+	res, err := tx.Query("SELECT data.id, pid, fname, key, nonce, users.kek FROM data, users " +
+		"WHERE data.pid_enc IS NULL AND users.id = data.uid AND users.kek_nonce IS NULL")
+	if err != nil {
+		return nil, err
+	}
+	type legacyPaste struct {
+		id    int64
+		pid   string
+		fname string
+		key   []byte
+		nonce []byte
+		kek   []byte
+	}
+	var pastes []legacyPaste
+	for res.Next() {
+		var p legacyPaste
+		err = res.Scan(&p.id, &p.pid, &p.fname, &p.key, &p.nonce, &p.kek)
+		if err != nil {
+			ec := res.Close()
+			if ec != nil {
+				log.Println(ec.Error())
+			}
+			return nil, err
+		}
+		pastes = append(pastes, p)
+	}
+	err = res.Close()
+	if err != nil {
+		return nil, err
+	}
+	// files written before a failure are not referenced after the rollback
+	var written, obsolete []string
+	fail := func(err error) ([]string, error) {
+		for _, fname := range written {
+			removeDataFile(fname)
+		}
+		return nil, err
+	}
+	for _, p := range pastes {
+		// only a paste whose file is gone is left behind, other errors roll
+		// back so that the migration runs again on the next start
+		file, err := readDataFile(p.fname)
+		if errors.Is(err, os.ErrNotExist) {
+			log.Println(err)
+			continue
+		}
+		if err != nil {
+			return fail(err)
+		}
+		sum := kdf(p.key, p.kek)
+		file, err = decrypt(file, sum[0:16], p.nonce)
+		zeroByteArray(sum)
+		if err != nil {
+			return fail(fmt.Errorf("legacy paste %d: %w", p.id, err))
+		}
+		key, err := generateRandomBytes(16)
+		if err != nil {
+			return fail(err)
+		}
+		nonce, err := generateRandomBytes(12)
+		if err != nil {
+			return fail(err)
+		}
+		rnd, err := generateRandomBytes(12)
+		if err != nil {
+			return fail(err)
+		}
+		fname := hex.EncodeToString(rnd)
+		lkey := tokenKey(p.pid)
+		sealed, err := encryptData(file, key, nonce, lkey)
+		zeroByteArray(lkey)
+		zeroByteArray(file)
+		if err != nil {
+			return fail(err)
+		}
+		pidEnc, err := sealWithKek([]byte(p.pid), p.kek)
+		if err != nil {
+			return fail(err)
+		}
+		if !dryRun {
+			err = writeDataFile(fname, sealed)
+			if err != nil {
+				return fail(err)
+			}
+			written = append(written, fname)
+		}
+		_, err = tx.Exec("UPDATE data SET pid = $1, pid_enc = $2, fname = $3, key = $4, nonce = $5 WHERE id = $6",
+			pidKey(p.pid), pidEnc, fname, key, nonce, p.id)
+		if err != nil {
+			return fail(err)
+		}
+		obsolete = append(obsolete, p.fname)
+	}
+	if len(obsolete) > 0 {
+		log.Printf("Migrated %d legacy pastes", len(obsolete))
+	}
+	return obsolete, nil
+}
+
+// readCredentials reads username and password from an urlencoded or multipart form
+func readCredentials(w http.ResponseWriter, r *http.Request) (string, string, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, 4096)
+	err := r.ParseMultipartForm(4096)
+	if err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		return "", "", err
+	}
+	username := r.PostFormValue("username")
+	password := r.PostFormValue("password")
+	if username == "" || password == "" {
+		return "", "", errors.New("missing credentials")
+	}
+	return username, password, nil
+}
+
+func passwordHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	if r == nil {
 		log.Println("http.Request is nil")
 		return
@@ -133,46 +672,139 @@ func loginHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 			log.Println(ec.Error())
 		}
 	}()
-	hash, err := io.ReadAll(io.LimitReader(r.Body, 100))
-	if string(hash) == CONFIGURATION.DatabasePersistUser {
+	sessid := sessionToken(r)
+	if sessid == "" {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
+	uid, _, err := sessionValid(DB, sessid, scopeSession)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 4096)
+	err = r.ParseMultipartForm(4096)
+	if err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	err = changePassword(DB, uid, r.PostFormValue("password"), r.PostFormValue("new-password"))
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func loginHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if r == nil {
+		log.Println("http.Request is nil")
+		return
+	}
 	defer func() {
 		ec := r.Body.Close()
 		if ec != nil {
 			log.Println(ec.Error())
 		}
 	}()
+	username, password, err := readCredentials(w, r)
 	if err != nil {
 		log.Println(err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	var uid int64
-	var kek []byte
-	err = DB.QueryRow("SELECT id, kek FROM users WHERE hash = $1", string(hash)).Scan(&uid, &kek)
+	keys := loginKeys(r, username)
+	if wait := loginLocked(keys...); wait > 0 {
+		tooManyRequests(w, wait)
+		return
+	}
+	uid, kek, err := authenticate(DB, username, password)
+	if errors.Is(err, errPendingApproval) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
 	if err != nil {
 		log.Println(err)
+		loginFailed(keys...)
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
-	sidb, err := generateRandomBytes(64)
+	err = checkSecondFactor(DB, uid, kek, r.PostFormValue("totp"))
+	if err != nil {
+		zeroByteArray(kek)
+		if errors.Is(err, errTotpRequired) {
+			w.Header().Set("pastae-totp", "required")
+		} else {
+			log.Println(err)
+			loginFailed(keys...)
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	loginSucceeded(keys...)
+	sid, err := createSession(DB, uid, kek, r.UserAgent())
 	if err != nil {
 		log.Println(err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	sid := hex.EncodeToString(sidb)
-	SESSIONMUTEX.Lock()
-	defer SESSIONMUTEX.Unlock()
-	SESSIONS[sid] = &Session{Created: time.Now().Unix(), Kek: kek, UserID: uid}
+	// browsers get a cookie session and only the CSRF token
+	if r.PostFormValue("cookie") != "" {
+		setSessionCookies(w, r, sid)
+		sid = csrfToken(sid)
+	}
 	_, err = w.Write([]byte(sid))
 	if err != nil {
 		log.Println(err.Error())
 	}
 }
 
+// createSession returns a new session ID for an authenticated user. The
+// session row only holds the user KEK wrapped with a key derived from the
+// session ID, which itself is stored hashed.
+func createSession(db *sql.DB, uid int64, kek []byte, userAgent string) (string, error) {
+	if db == nil {
+		return "", errors.New("nil db")
+	}
+	sidb, err := generateRandomBytes(64)
+	if err != nil {
+		return "", err
+	}
+	sid := hex.EncodeToString(sidb)
+	nonce, err := generateRandomBytes(12)
+	if err != nil {
+		return "", err
+	}
+	key := tokenKey(sid)
+	wrapped, err := encrypt(kek, key, nonce)
+	zeroByteArray(key)
+	zeroByteArray(kek)
+	if err != nil {
+		return "", err
+	}
+	if len(userAgent) > 256 {
+		userAgent = userAgent[:256]
+	}
+	now := time.Now().Unix()
+	_, err = db.Exec("INSERT INTO sessions (token, uid, kek, nonce, created, last_seen, user_agent) "+
+		"VALUES ($1, $2, $3, $4, $5, $6, $7)", tokenHash(sid), uid, wrapped, nonce, now, now, userAgent)
+	if err != nil {
+		return "", err
+	}
+	return sid, nil
+}
+
+func deleteSession(db *sql.DB, sid string) {
+	if db == nil {
+		return
+	}
+	_, err := db.Exec("DELETE FROM sessions WHERE token = $1", tokenHash(sid))
+	if err != nil {
+		log.Println(err)
+	}
+}
+
 func logoutHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	if r == nil {
 		log.Println("http.Request is nil")
@@ -184,7 +816,7 @@ func logoutHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params)
 			log.Println(ec.Error())
 		}
 	}()
-	hash, err := io.ReadAll(io.LimitReader(r.Body, 100))
+	hash, err := io.ReadAll(io.LimitReader(r.Body, 200))
 	defer func() {
 		ec := r.Body.Close()
 		if ec != nil {
@@ -195,13 +827,47 @@ func logoutHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	sid := string(hash)
+	if sid == "" {
+		sid = sessionToken(r)
+		clearSessionCookies(w, r)
+	}
 	w.WriteHeader(http.StatusOK)
-	go func(hash []byte) {
-		SESSIONMUTEX.Lock()
-		defer SESSIONMUTEX.Unlock()
-		_, _, err := sessionValid(DB, string(hash))
-		if err == nil {
-			delete(SESSIONS, string(hash))
-		}
-	}(hash)
+	go deleteSession(DB, sid)
+}
+
+// csrfToken is derived from the session ID so that it is bound to the
+// session and need not be stored
+func csrfToken(sid string) string {
+	sum := sha256.Sum256([]byte("pastae-csrf" + sid))
+	return hex.EncodeToString(sum[:])
+}
+
+func csrfValid(sid string, token string) bool {
+	return token != "" && subtle.ConstantTimeCompare([]byte(csrfToken(sid)), []byte(token)) == 1
+}
+
+func cookieSecure(r *http.Request) bool {
+	return r.TLS != nil || strings.HasPrefix(CONFIGURATION.URL, "https://")
+}
+
+// setSessionCookies stores the session ID in an HttpOnly cookie and the CSRF
+// token in a cookie readable by the web UI, which sends it back in the
+// pastae-csrf header
+func setSessionCookies(w http.ResponseWriter, r *http.Request, sid string) {
+	var maxAge int = 0
+	if CONFIGURATION.DatabaseSessionLifetime > 0 {
+		maxAge = int(CONFIGURATION.DatabaseSessionLifetime)
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: sid, Path: "/", MaxAge: maxAge,
+		HttpOnly: true, Secure: cookieSecure(r), SameSite: http.SameSiteStrictMode})
+	http.SetCookie(w, &http.Cookie{Name: csrfCookie, Value: csrfToken(sid), Path: "/", MaxAge: maxAge,
+		Secure: cookieSecure(r), SameSite: http.SameSiteStrictMode})
+}
+
+func clearSessionCookies(w http.ResponseWriter, r *http.Request) {
+	for _, name := range []string{sessionCookie, csrfCookie} {
+		http.SetCookie(w, &http.Cookie{Name: name, Value: "", Path: "/", MaxAge: -1,
+			HttpOnly: name == sessionCookie, Secure: cookieSecure(r), SameSite: http.SameSiteStrictMode})
+	}
 }
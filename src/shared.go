@@ -0,0 +1,228 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+	"time"
+)
+
+// In sharedState mode anonymous pastes, failed logins and pending OIDC logins
+// are kept in the metadata database instead of process memory, so that
+// instances behind a load balancer share them. Sessions and persisted pastes
+// are always in the database.
+func sharedState() bool {
+	return CONFIGURATION.SharedState && DB != nil
+}
+
+// newPasteID returns a random paste ID with an extension for contentType
+func newPasteID(contentType string) (string, error) {
+	rnd, err := generateRandomBytes(12)
+	if err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(rnd)
+	if ext := contentTypeExtension(contentType); ext != "" {
+		id += "." + ext
+	} else {
+		log.Println("Invalid Content Type: " + contentType)
+	}
+	return id, nil
+}
+
+// insertSharedPaste stores an anonymous paste encrypted with a key derived
+// from its ID, as KEK differs between instances. The oldest pastes are
+// dropped beyond MaxEntries.
+func insertSharedPaste(pasteData []byte, bar bool, contentType string, name string, dtoken []byte) (string, error) {
+	id, err := newPasteID(contentType)
+	if err != nil {
+		return err.Error(), err
+	}
+	nonce, err := generateRandomBytes(12)
+	if err != nil {
+		return err.Error(), err
+	}
+	key, err := generateRandomBytes(16)
+	if err != nil {
+		return err.Error(), err
+	}
+	lkey := tokenKey(id)
+	pasteData, err = encryptData(pasteData, key, nonce, lkey)
+	zeroByteArray(lkey)
+	if err != nil {
+		return err.Error(), err
+	}
+	tx, err := DB.Begin()
+	if err != nil {
+		return err.Error(), err
+	}
+	err = lockTable(tx, "ephemeral")
+	var count int
+	if err == nil {
+		err = tx.QueryRow("SELECT COUNT(id) FROM ephemeral").Scan(&count)
+	}
+	if err == nil && count >= CONFIGURATION.MaxEntries {
+		_, err = tx.Exec("DELETE FROM ephemeral WHERE id IN (SELECT id FROM ephemeral ORDER BY id LIMIT $1)",
+			count-CONFIGURATION.MaxEntries+1)
+	}
+	if err == nil {
+		_, err = tx.Exec("INSERT INTO ephemeral (pid, key, nonce, ct, name, dtoken, burn, payload) "+
+			"VALUES ($1, $2, $3, $4, $5, $6, $7, $8)", pidKey(id), key, nonce, contentType, name, dtoken,
+			boolInt(bar), pasteData)
+	}
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		ec := tx.Rollback()
+		if ec != nil {
+			log.Println(ec.Error())
+		}
+	}
+	if err != nil {
+		return err.Error(), err
+	}
+	return CONFIGURATION.URL + id, nil
+}
+
+// takeSharedPaste returns an anonymous paste and its content. A burn after
+// reading paste is deleted first and only the instance whose delete
+// succeeds serves it.
+func takeSharedPaste(id string) (*Pastae, []byte, error) {
+	var paste Pastae
+	var payload []byte
+	var burn int
+	err := DB.QueryRow("SELECT key, nonce, ct, name, burn, payload FROM ephemeral WHERE pid = $1", pidKey(id)).Scan(
+		&paste.Key, &paste.Nonce, &paste.ContentType, &paste.Name, &burn, &payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	paste.ID = id
+	paste.BurnAfterReading = burn != 0
+	if paste.BurnAfterReading {
+		ok, err := execAffected(DB, "DELETE FROM ephemeral WHERE pid = $1", pidKey(id))
+		if err != nil {
+			return nil, nil, err
+		}
+		if !ok {
+			return nil, nil, sql.ErrNoRows
+		}
+	}
+	lkey := tokenKey(id)
+	sum := kdf(paste.Key, lkey)
+	data, err := decrypt(payload, sum[0:16], paste.Nonce)
+	zeroByteArray(sum)
+	zeroByteArray(lkey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &paste, data, nil
+}
+
+func deleteSharedPaste(pid string, hash []byte) bool {
+	ok, err := execAffected(DB, "DELETE FROM ephemeral WHERE pid = $1 AND dtoken = $2", pidKey(pid), hash)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	return ok
+}
+
+// refreshPasteCount reloads SESSIONPASTECOUNT, which other instances change
+func refreshPasteCount(db *sql.DB) error {
+	var count int64 = 0
+	err := db.QueryRow("SELECT COUNT(id) FROM data").Scan(&count)
+	if err != nil {
+		return err
+	}
+	SESSIONPASTECOUNT.Store(count)
+	return nil
+}
+
+func sharedLoginLocked(keys ...string) int64 {
+	now := time.Now().Unix()
+	var wait int64 = 0
+	for _, key := range keys {
+		var lockedUntil int64
+		err := DB.QueryRow("SELECT locked_until FROM login_attempts WHERE akey = $1", key).Scan(&lockedUntil)
+		if err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				log.Println(err)
+			}
+			continue
+		}
+		if lockedUntil-now > wait {
+			wait = lockedUntil - now
+		}
+	}
+	return wait
+}
+
+// sharedLoginFailed counts a failure with an upsert so that concurrent
+// failures on different instances are all counted
+func sharedLoginFailed(keys ...string) {
+	now := time.Now().Unix()
+	for _, key := range keys {
+		var failures int
+		err := DB.QueryRow("INSERT INTO login_attempts (akey, failures, last_failure) VALUES ($1, 1, $2) "+
+			"ON CONFLICT (akey) DO UPDATE SET failures = CASE WHEN login_attempts.last_failure <= $3 THEN 1 "+
+			"ELSE login_attempts.failures + 1 END, last_failure = $2 RETURNING failures",
+			key, now, now-CONFIGURATION.LoginLockout).Scan(&failures)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		lock := loginLockDuration(failures)
+		if lock <= 0 {
+			continue
+		}
+		_, err = DB.Exec("UPDATE login_attempts SET locked_until = $1 WHERE akey = $2", now+lock, key)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func sharedLoginSucceeded(keys ...string) {
+	for _, key := range keys {
+		_, err := DB.Exec("DELETE FROM login_attempts WHERE akey = $1", key)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func sharedCleanLoginAttempts() {
+	now := time.Now().Unix()
+	_, err := DB.Exec("DELETE FROM login_attempts WHERE locked_until <= $1 AND last_failure <= $2", now,
+		now-CONFIGURATION.LoginLockout)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// saveSharedOIDCState stores a pending login by the hash of its state
+func saveSharedOIDCState(state string, login OIDCLoginState) error {
+	_, err := DB.Exec("DELETE FROM oidc_states WHERE created <= $1", login.Created-oidcStateLifetime)
+	if err != nil {
+		return err
+	}
+	_, err = DB.Exec("INSERT INTO oidc_states (state, verifier, nonce, created) VALUES ($1, $2, $3, $4)",
+		pidKey(state), login.Verifier, login.Nonce, login.Created)
+	return err
+}
+
+// takeSharedOIDCState removes and returns a pending login, a state is
+// accepted once by any instance
+func takeSharedOIDCState(state string) (OIDCLoginState, bool) {
+	var login OIDCLoginState
+	err := DB.QueryRow("DELETE FROM oidc_states WHERE state = $1 RETURNING verifier, nonce, created",
+		pidKey(state)).Scan(&login.Verifier, &login.Nonce, &login.Created)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Println(err)
+		}
+		return login, false
+	}
+	return login, true
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// API token scopes. Session management and account operations are only
+// allowed with a login session.
+const scopeSession string = ""
+const scopeUpload string = "upload"
+const scopeList string = "list"
+const scopeDelete string = "delete"
+const scopeExpiry string = "expiry"
+
+var apiTokenScopes = []string{scopeUpload, scopeList, scopeDelete, scopeExpiry}
+
+// apiTokenPrefix tells API tokens apart from session IDs
+const apiTokenPrefix string = "pastae_"
+
+type ApiTokenListing struct {
+	ID       int64
+	Name     string
+	Scopes   []string
+	Created  int64
+	Expire   int64
+	LastUsed int64
+}
+
+// sessionToken returns the session ID of a request, the bearer token of the
+// Authorization header or the session cookie. Cookie sessions need a valid
+// CSRF token header for other than GET and HEAD requests.
+func sessionToken(r *http.Request) string {
+	if sessid := r.Header.Get("pastae-sessid"); sessid != "" {
+		return sessid
+	}
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil || cookie.Value == "" {
+		return ""
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead &&
+		!csrfValid(cookie.Value, r.Header.Get("pastae-csrf")) {
+		return ""
+	}
+	return cookie.Value
+}
+
+func parseScopes(s string) ([]string, error) {
+	var scopes []string
+	for _, scope := range strings.Split(s, ",") {
+		scope = strings.TrimSpace(scope)
+		if scope == "" {
+			continue
+		}
+		if !slices.Contains(apiTokenScopes, scope) {
+			return nil, errors.New("unknown scope " + scope)
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	if len(scopes) == 0 {
+		return nil, errors.New("no scopes")
+	}
+	return scopes, nil
+}
+
+// createApiToken returns a new API token of a user. Like sessions, the token
+// is stored hashed and holds the user KEK wrapped with a key derived from it.
+func createApiToken(db *sql.DB, uid int64, kek []byte, name string, scopes []string, days int64) (string, error) {
+	if db == nil {
+		return "", errors.New("nil db")
+	}
+	defer zeroByteArray(kek)
+	if len(name) > 256 {
+		return "", errors.New("too long token name")
+	}
+	if days < 0 {
+		return "", errors.New("negative expiry")
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(apiTokenScopes, scope) {
+			return "", errors.New("unknown scope " + scope)
+		}
+	}
+	rnd, err := generateRandomBytes(32)
+	if err != nil {
+		return "", err
+	}
+	token := apiTokenPrefix + hex.EncodeToString(rnd)
+	nonce, err := generateRandomBytes(12)
+	if err != nil {
+		return "", err
+	}
+	key := tokenKey(token)
+	wrapped, err := encrypt(kek, key, nonce)
+	zeroByteArray(key)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().Unix()
+	var expire sql.NullInt64
+	if days > 0 {
+		expire = sql.NullInt64{Int64: now + days*24*60*60, Valid: true}
+	}
+	_, err = db.Exec("INSERT INTO tokens (token, uid, name, scopes, kek, nonce, created, expire) "+
+		"VALUES ($1, $2, $3, $4, $5, $6, $7, $8)", tokenHash(token), uid, name, strings.Join(scopes, ","),
+		wrapped, nonce, now, expire)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func apiTokenValid(db *sql.DB, token string, scope string) (int64, []byte, error) {
+	var id int64
+	var uid int64
+	var scopes string
+	var wrapped []byte
+	var nonce []byte
+	now := time.Now().Unix()
+	err := db.QueryRow("SELECT id, uid, scopes, kek, nonce FROM tokens WHERE token = $1 "+
+		"AND (expire IS NULL OR expire > $2)", tokenHash(token), now).Scan(&id, &uid, &scopes, &wrapped, &nonce)
+	if err != nil || !slices.Contains(strings.Split(scopes, ","), scope) {
+		return -100, []byte("Invalid token"), errors.New("sessionValid")
+	}
+	key := tokenKey(token)
+	kek, err := decrypt(wrapped, key, nonce)
+	zeroByteArray(key)
+	if err != nil {
+		return -100, []byte("Invalid token"), errors.New("sessionValid")
+	}
+	_, err = db.Exec("UPDATE tokens SET last_used = $1 WHERE id = $2", now, id)
+	if err != nil {
+		log.Println(err)
+	}
+	return uid, kek, nil
+}
+
+func listApiTokens(db *sql.DB, uid int64) ([]ApiTokenListing, error) {
+	res, err := db.Query("SELECT id, COALESCE(name,''), scopes, created, COALESCE(expire,0), "+
+		"COALESCE(last_used,0) FROM tokens WHERE uid = $1 ORDER BY id", uid)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		ec := res.Close()
+		if ec != nil {
+			log.Println(ec.Error())
+		}
+	}()
+	tokens := []ApiTokenListing{}
+	for res.Next() {
+		var elem ApiTokenListing
+		var scopes string
+		err = res.Scan(&elem.ID, &elem.Name, &scopes, &elem.Created, &elem.Expire, &elem.LastUsed)
+		if err != nil {
+			return nil, err
+		}
+		elem.Scopes = strings.Split(scopes, ",")
+		tokens = append(tokens, elem)
+	}
+	return tokens, res.Err()
+}
+
+func revokeApiToken(db *sql.DB, uid int64, id int64) (bool, error) {
+	res, err := db.Exec("DELETE FROM tokens WHERE id = $1 AND uid = $2", id, uid)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func cleanApiTokens(db *sql.DB) {
+	if db == nil {
+		return
+	}
+	_, err := db.Exec("DELETE FROM tokens WHERE expire IS NOT NULL AND expire <= $1", time.Now().Unix())
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func tokensHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if r == nil {
+		log.Println("http.Request is nil")
+		return
+	}
+	defer func() {
+		ec := r.Body.Close()
+		if ec != nil {
+			log.Println(ec.Error())
+		}
+	}()
+	sessid := sessionToken(r)
+	if sessid == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	uid, _, err := sessionValid(DB, sessid, scopeSession)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	tokens, err := listApiTokens(DB, uid)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	bytes, err := json.Marshal(tokens)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	_, err = w.Write(bytes)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// createTokenHandler reads form fields name, scopes (comma separated) and
+// optional expire in days and responds with the token
+func createTokenHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if r == nil {
+		log.Println("http.Request is nil")
+		return
+	}
+	defer func() {
+		ec := r.Body.Close()
+		if ec != nil {
+			log.Println(ec.Error())
+		}
+	}()
+	sessid := sessionToken(r)
+	if sessid == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	uid, kek, err := sessionValid(DB, sessid, scopeSession)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 4096)
+	err = r.ParseMultipartForm(4096)
+	if err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		zeroByteArray(kek)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	scopes, err := parseScopes(r.PostFormValue("scopes"))
+	if err != nil {
+		zeroByteArray(kek)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var days int64 = 0
+	if e := r.PostFormValue("expire"); e != "" {
+		days, err = strconv.ParseInt(e, 10, 64)
+		if err != nil || days < 0 {
+			zeroByteArray(kek)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	token, err := createApiToken(DB, uid, kek, r.PostFormValue("name"), scopes, days)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	_, err = w.Write([]byte(token))
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+func revokeTokenHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if r == nil {
+		log.Println("http.Request is nil")
+		return
+	}
+	defer func() {
+		ec := r.Body.Close()
+		if ec != nil {
+			log.Println(ec.Error())
+		}
+	}()
+	sessid := sessionToken(r)
+	if sessid == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	uid, _, err := sessionValid(DB, sessid, scopeSession)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	id, err := strconv.ParseInt(p.ByName("id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	ok, err := revokeApiToken(DB, uid, id)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// RFC 6238 parameters compatible with common authenticator apps
+const totpPeriod int64 = 30
+const totpDigits int = 6
+const totpRecoveryCodes int = 10
+
+var errTotpRequired = errors.New("totp required")
+
+type TotpSetup struct {
+	Secret string
+	URI    string
+}
+
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, code%1000000)
+}
+
+// totpVerify accepts codes from one time step before and after now to allow
+// for clock drift. Codes of steps up to last have already been used.
+func totpVerify(secret []byte, code string, now int64, last int64) (int64, bool) {
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	step := now / totpPeriod
+	for i := step - 1; i <= step+1; i++ {
+		if i <= last {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, i)), []byte(code)) == 1 {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func totpURI(username string, secret []byte) string {
+	label := url.PathEscape("pastae:" + username)
+	v := url.Values{}
+	v.Set("secret", base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret))
+	v.Set("issuer", "pastae")
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// setupTotp stores a new pending TOTP secret sealed with the user KEK. The
+// secret is only used for login once enableTotp has verified a code.
+func setupTotp(db *sql.DB, uid int64, kek []byte) (TotpSetup, error) {
+	var username sql.NullString
+	var enabled bool
+	err := db.QueryRow("SELECT username, COALESCE(totp_enabled,0) FROM users WHERE id = $1",
+		uid).Scan(&username, &enabled)
+	if err != nil {
+		return TotpSetup{}, err
+	}
+	if !username.Valid {
+		return TotpSetup{}, errors.New("user has no username")
+	}
+	if enabled {
+		return TotpSetup{}, errors.New("totp already enabled")
+	}
+	secret, err := generateRandomBytes(20)
+	if err != nil {
+		return TotpSetup{}, err
+	}
+	sealed, err := sealWithKek(secret, kek)
+	if err != nil {
+		return TotpSetup{}, err
+	}
+	_, err = db.Exec("UPDATE users SET totp_secret = $1, totp_enabled = 0, totp_last = 0, totp_recovery = NULL "+
+		"WHERE id = $2", sealed, uid)
+	if err != nil {
+		return TotpSetup{}, err
+	}
+	setup := TotpSetup{Secret: base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret),
+		URI: totpURI(username.String, secret)}
+	zeroByteArray(secret)
+	return setup, nil
+}
+
+// enableTotp verifies a code for the pending secret, enables TOTP and returns
+// recovery codes which are only stored hashed
+func enableTotp(db *sql.DB, uid int64, kek []byte, code string) ([]string, error) {
+	var sealed []byte
+	var enabled bool
+	err := db.QueryRow("SELECT totp_secret, COALESCE(totp_enabled,0) FROM users WHERE id = $1",
+		uid).Scan(&sealed, &enabled)
+	if err != nil {
+		return nil, err
+	}
+	if enabled || sealed == nil {
+		return nil, errors.New("no pending totp setup")
+	}
+	secret, err := openWithKek(sealed, kek)
+	if err != nil {
+		return nil, err
+	}
+	step, ok := totpVerify(secret, code, time.Now().Unix(), 0)
+	zeroByteArray(secret)
+	if !ok {
+		return nil, errors.New("invalid totp code")
+	}
+	var codes []string
+	var hashes []string
+	for i := 0; i < totpRecoveryCodes; i++ {
+		rnd, err := generateRandomBytes(8)
+		if err != nil {
+			return nil, err
+		}
+		c := hex.EncodeToString(rnd)
+		codes = append(codes, c)
+		hashes = append(hashes, hex.EncodeToString(tokenHash(c)))
+	}
+	recovery, err := json.Marshal(hashes)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec("UPDATE users SET totp_enabled = 1, totp_last = $1, totp_recovery = $2 WHERE id = $3",
+		step, string(recovery), uid)
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func disableTotp(db *sql.DB, uid int64) error {
+	_, err := db.Exec("UPDATE users SET totp_secret = NULL, totp_enabled = 0, totp_last = NULL, "+
+		"totp_recovery = NULL WHERE id = $1", uid)
+	return err
+}
+
+// checkSecondFactor verifies a TOTP or recovery code of a user who has
+// already given the password. Users without TOTP pass with an empty code.
+func checkSecondFactor(db *sql.DB, uid int64, kek []byte, code string) error {
+	var enabled bool
+	var sealed []byte
+	var last int64
+	var recovery string
+	err := db.QueryRow("SELECT COALESCE(totp_enabled,0), totp_secret, COALESCE(totp_last,0), "+
+		"COALESCE(totp_recovery,'') FROM users WHERE id = $1", uid).Scan(&enabled, &sealed, &last, &recovery)
+	if err != nil {
+		return err
+	}
+	if !enabled {
+		return nil
+	}
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	if code == "" {
+		return errTotpRequired
+	}
+	if len(code) == totpDigits {
+		secret, err := openWithKek(sealed, kek)
+		if err != nil {
+			return err
+		}
+		step, ok := totpVerify(secret, code, time.Now().Unix(), last)
+		zeroByteArray(secret)
+		if !ok {
+			return errors.New("invalid totp code")
+		}
+		res, err := db.Exec("UPDATE users SET totp_last = $1 WHERE id = $2 AND COALESCE(totp_last,0) < $1", step, uid)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			return errors.New("totp code already used")
+		}
+		return nil
+	}
+	var hashes []string
+	err = json.Unmarshal([]byte(recovery), &hashes)
+	if err != nil {
+		return err
+	}
+	hash := hex.EncodeToString(tokenHash(code))
+	for i, h := range hashes {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+			rest, err := json.Marshal(append(hashes[:i:i], hashes[i+1:]...))
+			if err != nil {
+				return err
+			}
+			res, err := db.Exec("UPDATE users SET totp_recovery = $1 WHERE id = $2 AND totp_recovery = $3",
+				string(rest), uid, recovery)
+			if err != nil {
+				return err
+			}
+			if n, err := res.RowsAffected(); err != nil || n == 0 {
+				return errors.New("recovery code already used")
+			}
+			return nil
+		}
+	}
+	return errors.New("invalid recovery code")
+}
+
+func totpSetupHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if r == nil {
+		log.Println("http.Request is nil")
+		return
+	}
+	defer func() {
+		ec := r.Body.Close()
+		if ec != nil {
+			log.Println(ec.Error())
+		}
+	}()
+	sessid := sessionToken(r)
+	if sessid == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	uid, kek, err := sessionValid(DB, sessid, scopeSession)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	setup, err := setupTotp(DB, uid, kek)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	bytes, err := json.Marshal(setup)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	_, err = w.Write(bytes)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+func totpEnableHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if r == nil {
+		log.Println("http.Request is nil")
+		return
+	}
+	defer func() {
+		ec := r.Body.Close()
+		if ec != nil {
+			log.Println(ec.Error())
+		}
+	}()
+	sessid := sessionToken(r)
+	if sessid == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	uid, kek, err := sessionValid(DB, sessid, scopeSession)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 4096)
+	err = r.ParseMultipartForm(4096)
+	if err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	codes, err := enableTotp(DB, uid, kek, r.PostFormValue("totp"))
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	bytes, err := json.Marshal(codes)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	_, err = w.Write(bytes)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// totpDisableHandler requires the password and a TOTP or recovery code
+func totpDisableHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if r == nil {
+		log.Println("http.Request is nil")
+		return
+	}
+	defer func() {
+		ec := r.Body.Close()
+		if ec != nil {
+			log.Println(ec.Error())
+		}
+	}()
+	sessid := sessionToken(r)
+	if sessid == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	uid, _, err := sessionValid(DB, sessid, scopeSession)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 4096)
+	err = r.ParseMultipartForm(4096)
+	if err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	err = verifyUserSecondFactor(DB, uid, r.PostFormValue("password"), r.PostFormValue("totp"))
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	err = disableTotp(DB, uid)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// verifyUserSecondFactor re-authenticates the session user with password and
+// a TOTP or recovery code
+func verifyUserSecondFactor(db *sql.DB, uid int64, password string, code string) error {
+	var username string
+	err := db.QueryRow("SELECT username FROM users WHERE id = $1", uid).Scan(&username)
+	if err != nil {
+		return err
+	}
+	id, kek, err := authenticate(db, username, password)
+	if err != nil {
+		return err
+	}
+	defer zeroByteArray(kek)
+	if id != uid {
+		return errors.New("user mismatch")
+	}
+	return checkSecondFactor(db, uid, kek, code)
+}
@@ -1,19 +1,26 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"io"
 	"log"
 	"net/http"
-	"os"
+	"path"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
 )
 
+var errUnauthorized = errors.New("unauthorized")
+var errContentType = errors.New("unsupported content type")
+
 func uploadPaste(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	uploadPasteImpl(w, r, false)
 }
@@ -49,7 +56,7 @@ func uploadPasteImpl(w http.ResponseWriter, r *http.Request, session bool) {
 	var uid int64 = 0
 	var ukek []byte
 	if session {
-		uidt, ukekt, err := sessionValid(DB, r.Header.Get("pastae-sessid"))
+		uidt, ukekt, err := sessionValid(DB, sessionToken(r), scopeUpload)
 		if err != nil {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
@@ -59,54 +66,24 @@ func uploadPasteImpl(w http.ResponseWriter, r *http.Request, session bool) {
 		if r.FormValue("expire") == "30" {
 			expire = time.Now().Unix() + 30*24*60*60
 		}
-		if SESSIONPASTECOUNT.Load() >= CONFIGURATION.DatabaseMaxEntries {
-			go func() {
-				var fname string
-				err = DB.QueryRow("DELETE FROM data WHERE id =" +
-					"(SELECT id FROM data ORDER BY id LIMIT 1) RETURNING fname").Scan(&fname)
-				if err != nil {
-					log.Println(err)
-				}
-				if fname == "" {
-					log.Println("empty file name")
-					return
-				}
-				err = os.Remove(CONFIGURATION.DataPath + fname)
-				if err != nil {
-					log.Println(err)
-				}
-			}()
-		}
 	}
 	contentType := r.FormValue("content-type")
 	bar := r.FormValue("bar") == "bar"
 	if contentType == "text/plain" {
 		contentType += ";charset=utf-8"
-		var id string
-		if session {
-			if bar {
-				id, err = insertPaste([]byte(r.FormValue("data")), bar, contentType)
-				if err != nil {
-					w.WriteHeader(http.StatusInternalServerError)
-					log.Println(err)
-					return
-				}
-			} else {
-				id, err = insertPasteToFile([]byte(r.FormValue("data")), contentType, uid, expire, ukek)
-				if err != nil {
-					w.WriteHeader(http.StatusInternalServerError)
-					log.Println(err)
-					return
-				}
-				SESSIONPASTECOUNT.Add(1)
-			}
-		} else {
-			id, err = insertPaste([]byte(r.FormValue("data")), bar, contentType)
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				log.Println(err)
-				return
-			}
+		id, err := storePaste([]byte(r.FormValue("data")), contentType, bar, session, uid, expire, ukek, "", nil)
+		if err == errQuotaExceeded {
+			quotaExceeded(w)
+			return
+		}
+		if err == errStorageFull {
+			storageFull(w)
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println(err)
+			return
 		}
 		if err := r.Body.Close(); err != nil {
 			w.WriteHeader(http.StatusBadRequest)
@@ -141,55 +118,247 @@ func uploadPasteImpl(w http.ResponseWriter, r *http.Request, session bool) {
 		log.Println("Reading file")
 		return
 	}
-	valid, contentType := validContentType(data)
+	fileName := pasteName(header.Filename)
+	valid, contentType := validContentType(data, fileName)
 	if !valid {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	var id string
-	if session {
-		if bar {
-			id, err = insertPaste(data, bar, contentType)
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				log.Println(err)
-				return
-			}
-		} else {
-			id, err = insertPasteToFile(data, contentType, uid, expire, ukek)
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				log.Println(err)
-				return
-			}
-			SESSIONPASTECOUNT.Add(1)
+	id, err := storePaste(data, contentType, bar, session, uid, expire, ukek, fileName, nil)
+	if err == errQuotaExceeded {
+		quotaExceeded(w)
+		return
+	}
+	if err == errStorageFull {
+		storageFull(w)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	if err := r.Body.Close(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("Body close")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write([]byte(id))
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// pasteName returns the base name of an uploaded file name, or an empty name
+// if there is none or it is longer than 255 bytes
+func pasteName(name string) string {
+	name = path.Base(name)
+	if name == "." || name == "/" || len(name) > 255 {
+		return ""
+	}
+	return name
+}
+
+func uploadRaw(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	uploadRawImpl(w, r, p, false)
+}
+
+func uploadRawS(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	uploadRawImpl(w, r, p, true)
+}
+
+// uploadRawImpl stores the request body as is. Options are taken from query
+// parameters or the corresponding pastae-* headers. The body is buffered in
+// memory up to the maximum entry size, as it is encrypted as a whole.
+func uploadRawImpl(w http.ResponseWriter, r *http.Request, p httprouter.Params, session bool) {
+	if r == nil {
+		log.Println("http.Request is nil")
+		return
+	}
+	defer func() {
+		ec := r.Body.Close()
+		if ec != nil {
+			log.Println(ec.Error())
 		}
+	}()
+	var maxEntrySize int64
+	if session {
+		maxEntrySize = CONFIGURATION.DatabaseMaxEntrySize
 	} else {
-		id, err = insertPaste(data, bar, contentType)
+		maxEntrySize = CONFIGURATION.MaxEntrySize
+	}
+	if r.ContentLength > maxEntrySize {
+		log.Printf("ContentLength (%d) > maxEntrySize (%d)", r.ContentLength, maxEntrySize)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxEntrySize))
+	if err != nil {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		log.Println("Reading body")
+		return
+	}
+	if len(data) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	bar := rawOption(r, "bar")
+	burn := bar == "1" || bar == "true" || bar == "bar"
+	fileName := rawOption(r, "filename")
+	if fileName == "" {
+		fileName = p.ByName("filename")
+	}
+	fileName = pasteName(fileName)
+	var days int64 = 0
+	if e := rawOption(r, "expire"); e != "" {
+		days, err = strconv.ParseInt(e, 10, 64)
+		if err != nil || days <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	url, token, err := createPaste(data, "", burn, session, sessionToken(r), days, fileName)
+	zeroByteArray(data)
+	if err != nil {
+		switch err {
+		case errUnauthorized:
+			w.WriteHeader(http.StatusUnauthorized)
+		case errContentType:
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+		case errQuotaExceeded:
+			quotaExceeded(w)
+		case errStorageFull:
+			storageFull(w)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println(err)
+		}
+		return
+	}
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		bytes, err := json.Marshal(RawUploadResponse{URL: url, DeleteToken: token})
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			log.Println(err)
 			return
 		}
-	}
-	if err := r.Body.Close(); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		log.Println("Body close")
+		w.Header().Set("content-type", "application/json")
+		_, err = w.Write(bytes)
+		if err != nil {
+			log.Println(err.Error())
+		}
 		return
 	}
-	w.WriteHeader(http.StatusOK)
-	_, err = w.Write([]byte(id))
+	w.Header().Set("content-type", "text/plain;charset=utf-8")
+	_, err = w.Write([]byte(url + "\n" + token + "\n"))
 	if err != nil {
 		log.Println(err.Error())
 	}
 }
 
-func insertPaste(pasteData []byte, bar bool, contentType string) (string, error) {
+// createPaste stores a paste on behalf of the session sessid and returns its
+// URL and deletion token. An empty contentType is sniffed from data.
+func createPaste(data []byte, contentType string, bar bool, session bool,
+	sessid string, days int64, name string) (string, string, error) {
+	var expire int64 = 0
+	var uid int64 = 0
+	var ukek []byte
+	if session {
+		uidt, ukekt, err := sessionValid(DB, sessid, scopeUpload)
+		if err != nil {
+			return "", "", errUnauthorized
+		}
+		uid = uidt
+		ukek = ukekt
+		if days > 0 {
+			expire = time.Now().Unix() + days*24*60*60
+		}
+	}
+	valid, contentType := declaredContentType(data, name, contentType)
+	if !valid {
+		return "", "", errContentType
+	}
+	tokenb, err := generateRandomBytes(16)
+	if err != nil {
+		return "", "", err
+	}
+	token := hex.EncodeToString(tokenb)
+	url, err := storePaste(data, contentType, bar, session, uid, expire, ukek, name, deleteTokenHash(token))
+	if err != nil {
+		return "", "", err
+	}
+	return url, token, nil
+}
+
+func rawOption(r *http.Request, name string) string {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		v = r.Header.Get("pastae-" + name)
+	}
+	return v
+}
+
+func deleteTokenHash(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
+
+func storePaste(data []byte, contentType string, bar bool, session bool,
+	uid int64, expire int64, ukek []byte, fileName string, dtoken []byte) (string, error) {
+	if session && !bar {
+		QUOTAMUTEX.Lock()
+		defer QUOTAMUTEX.Unlock()
+		id, err := insertPasteToFile(data, contentType, uid, expire, ukek, fileName, dtoken)
+		if err != nil {
+			return id, err
+		}
+		SESSIONPASTECOUNT.Add(1)
+		return id, nil
+	}
+	return insertPaste(data, bar, contentType, fileName, dtoken)
+}
+
+func quotaExceeded(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusForbidden)
+	_, err := w.Write([]byte(errQuotaExceeded.Error()))
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+func insertPaste(pasteData []byte, bar bool, contentType string, name string, dtoken []byte) (string, error) {
+	if sharedState() {
+		return insertSharedPaste(pasteData, bar, contentType, name, dtoken)
+	}
+	id, err := newPasteID(contentType)
+	if err != nil {
+		return err.Error(), err
+	}
+	err = storeMemoryPaste(id, pasteData, bar, contentType, name, dtoken)
+	if err != nil {
+		return err.Error(), err
+	}
+	if peersEnabled() {
+		// replicated in the background so that peers that are down do not
+		// delay the upload, the caller may zero pasteData meanwhile
+		go replicatePaste(PeerPaste{ID: id, ContentType: contentType, BurnAfterReading: bar, Name: name,
+			DeleteToken: dtoken, Data: bytes.Clone(pasteData)})
+	}
+	return CONFIGURATION.URL + id, nil
+}
+
+// storeMemoryPaste encrypts a paste with KEK into PASTAEMAP, dropping the
+// oldest paste beyond MaxEntries
+func storeMemoryPaste(id string, pasteData []byte, bar bool, contentType string, name string, dtoken []byte) error {
 	if PASTAELIST == nil {
-		return "", errors.New("PASTAELIST is nil")
+		return errors.New("PASTAELIST is nil")
 	}
 	PASTAEMUTEX.Lock()
 	defer PASTAEMUTEX.Unlock()
+	if _, ok := TOMBSTONES[id]; ok {
+		return errTombstoned
+	}
 	if len(PASTAEMAP) >= CONFIGURATION.MaxEntries {
 		if PASTAELIST.Len() > 0 {
 			delete(PASTAEMAP, PASTAELIST.Front().Value.(Pastae).ID)
@@ -198,55 +367,30 @@ func insertPaste(pasteData []byte, bar bool, contentType string) (string, error)
 	}
 	nonce, err := generateRandomBytes(12)
 	if err != nil {
-		return err.Error(), err
+		return err
 	}
 	key, err := generateRandomBytes(16)
 	if err != nil {
-		return err.Error(), err
+		return err
 	}
 	pasteData, err = encryptData(pasteData, key, nonce, KEK)
 	if err != nil {
-		return err.Error(), err
-	}
-	rnd, err := generateRandomBytes(12)
-	if err != nil {
-		return err.Error(), err
+		return err
 	}
-	id := hex.EncodeToString(rnd)
-	if strings.HasPrefix(contentType, "text/plain") {
-		id += ".txt"
-	} else {
-		ct := strings.Split(contentType, "/")
-		if len(ct) != 1 {
-			id += "." + ct[1]
-		} else {
-			log.Println("Invalid Content Type: " + contentType)
-		}
-	}
-	paste := Pastae{ID: id, BurnAfterReading: bar, ContentType: contentType, Nonce: nonce, Key: key, Payload: pasteData}
+	paste := Pastae{ID: id, BurnAfterReading: bar, ContentType: contentType, Nonce: nonce, Key: key, Payload: pasteData,
+		Name: name, DeleteToken: dtoken}
 	PASTAEMAP[id] = &paste
 	PASTAELIST.PushBack(paste)
-	return CONFIGURATION.URL + id, nil
+	return nil
 }
 
 func insertPasteToFile(pasteData []byte,
-	contentType string, uid int64, expire int64, ukek []byte) (string, error) {
-	rnd, err := generateRandomBytes(12)
+	contentType string, uid int64, expire int64, ukek []byte, name string, dtoken []byte) (string, error) {
+	id, err := newPasteID(contentType)
 	if err != nil {
 		return err.Error(), err
 	}
-	id := hex.EncodeToString(rnd)
-	if contentType == "text/plain" || contentType == "text/plain;charset=utf-8" {
-		id += ".txt"
-	} else {
-		ct := strings.Split(contentType, "/")
-		if len(ct) != 1 {
-			id += "." + ct[1]
-		} else {
-			log.Println("Invalid Content Type: " + contentType)
-		}
-	}
-	rnd, err = generateRandomBytes(12)
+	rnd, err := generateRandomBytes(12)
 	if err != nil {
 		return err.Error(), err
 	}
@@ -262,50 +406,67 @@ func insertPasteToFile(pasteData []byte,
 	if err != nil {
 		return err.Error(), err
 	}
-	var dbErr error
-	var fileErr error
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func(uid int64, id string, fileName string, key []byte, nonce []byte, ct string, dbErr *error) {
-		defer wg.Done()
-		if expire == 0 {
-			qs := "INSERT INTO data (uid, pid, fname, key, nonce, ct)" +
-				"VALUES ($1, $2, $3, $4, $5, $6)"
-			_, err := DB.Exec(qs, uid, id, fileName, key, nonce, contentType)
-			if err != nil {
-				*dbErr = err
-				return
-			}
-		} else {
-			qs := "INSERT INTO data (uid, pid, fname, key, nonce, ct, expire)" +
-				"VALUES ($1, $2, $3, $4, $5, $6, $7)"
-			_, err := DB.Exec(qs, uid, id, fileName, key, nonce, contentType, expire)
-			if err != nil {
-				*dbErr = err
-				return
-			}
-		}
-	}(uid, id, fileName, key, nonce, contentType, &dbErr)
-	wg.Add(1)
-	go func(pasteData []byte, fileName string, key []byte, nonce []byte, ukek []byte, fileErr *error) {
-		defer wg.Done()
-		pasteData, err = encryptData(pasteData, key, nonce, ukek)
-		if err != nil {
-			*fileErr = err
-			return
-		}
-		err := os.WriteFile(CONFIGURATION.DataPath+fileName, pasteData, 0644)
-		if err != nil {
-			*fileErr = err
-			return
-		}
-	}(pasteData, fileName, key, nonce, ukek, &fileErr)
-	wg.Wait()
-	if fileErr != dbErr {
-		if dbErr != nil {
-			return dbErr.Error(), dbErr
+	// The paste is encrypted with a key derived from its ID, the owner finds
+	// the ID in the database encrypted with the owner KEK
+	pidEnc, err := sealWithKek([]byte(id), ukek)
+	if err != nil {
+		return err.Error(), err
+	}
+	// The quota check, eviction and the insert are one transaction, which is
+	// committed only after the data file is written
+	tx, err := DB.Begin()
+	if err != nil {
+		return err.Error(), err
+	}
+	rollback := func(err error) (string, error) {
+		ec := tx.Rollback()
+		if ec != nil {
+			log.Println(ec.Error())
 		}
-		return fileErr.Error(), fileErr
+		return err.Error(), err
+	}
+	err = lockTable(tx, "data")
+	if err != nil {
+		return rollback(err)
+	}
+	err = checkQuota(tx, uid, int64(len(pasteData)))
+	if err != nil {
+		return rollback(err)
+	}
+	evicted, err := evictPastes(tx)
+	if err != nil {
+		return rollback(err)
+	}
+	var expireAt sql.NullInt64
+	if expire != 0 {
+		expireAt = sql.NullInt64{Int64: expire, Valid: true}
+	}
+	qs := "INSERT INTO data (uid, pid, pid_enc, fname, key, nonce, ct, name, dtoken, size, expire)" +
+		"VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)"
+	_, err = tx.Exec(qs, uid, pidKey(id), pidEnc, fileName, key, nonce, contentType, name, dtoken,
+		len(pasteData), expireAt)
+	if err != nil {
+		return rollback(err)
+	}
+	lkey := tokenKey(id)
+	pasteData, err = encryptData(pasteData, key, nonce, lkey)
+	zeroByteArray(lkey)
+	if err != nil {
+		return rollback(err)
+	}
+	err = writeDataFile(fileName, pasteData)
+	if err != nil {
+		return rollback(err)
+	}
+	// the file is an orphan until the commit, removed here or by fsck
+	err = tx.Commit()
+	if err != nil {
+		removeDataFile(fileName)
+		return err.Error(), err
+	}
+	SESSIONPASTECOUNT.Add(-int64(len(evicted)))
+	for _, fname := range evicted {
+		removeDataFile(fname)
 	}
 	return CONFIGURATION.URL + id, nil
 }
@@ -321,35 +482,71 @@ func deleteHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params)
 			log.Println(ec.Error())
 		}
 	}()
-	sessid := r.Header.Get("pastae-sessid")
-	if sessid == "" {
+	token := rawOption(r, "delete-token")
+	if token != "" {
+		if deletePasteWithToken(p.ByName("id"), token) {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		return
+	}
+	sessid := sessionToken(r)
+	if sessid == "" || DB == nil {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
-	_, _, err := sessionValid(DB, sessid)
+	uid, _, err := sessionValid(DB, sessid, scopeDelete)
 	if err != nil {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
-	go func(pid string) {
-		var fname string
-		err := DB.QueryRow("DELETE FROM data WHERE pid = $1 RETURNING fname", pid).Scan(&fname)
-		if err != nil {
-			log.Println(err)
-			return
+	_, err = deleteDataRows(DB, "DELETE FROM data WHERE pid = $1 AND uid = $2 RETURNING fname",
+		pidKey(p.ByName("id")), uid)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// deletePasteWithToken removes an in-memory or persisted paste if the
+// deletion token handed out on upload matches.
+func deletePasteWithToken(pid string, token string) bool {
+	hash := deleteTokenHash(token)
+	if sharedState() && deleteSharedPaste(pid, hash) {
+		return true
+	}
+	if deleteMemoryPaste(pid, hash) {
+		if peersEnabled() {
+			deleteOnPeers(pid, hash)
 		}
-		if fname == "" {
-			log.Println("empty file name")
-			SESSIONPASTECOUNT.Add(-1)
+		return true
+	}
+	if peersEnabled() && deleteOnPeers(pid, hash) {
+		return true
+	}
+	if DB == nil {
+		return false
+	}
+	n, err := deleteDataRows(DB, "DELETE FROM data WHERE pid = $1 AND dtoken = $2 RETURNING fname", pidKey(pid), hash)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	return n > 0
+}
+
+// removePaste drops an in-memory paste, PASTAEMUTEX must be held
+func removePaste(id string) {
+	delete(PASTAEMAP, id)
+	for e := PASTAELIST.Front(); e != nil; e = e.Next() {
+		if e.Value.(Pastae).ID == id {
+			PASTAELIST.Remove(e)
 			return
 		}
-		err = os.Remove(CONFIGURATION.DataPath + fname)
-		if err != nil {
-			log.Println(err)
-		}
-		SESSIONPASTECOUNT.Add(-1)
-	}(p.ByName("id"))
-	w.WriteHeader(http.StatusOK)
+	}
 }
 
 func encryptData(payload []byte, key []byte, nonce []byte, kek []byte) ([]byte, error) {
@@ -361,11 +558,3 @@ func encryptData(payload []byte, key []byte, nonce []byte, kek []byte) ([]byte,
 	}
 	return payload, nil
 }
-
-func validContentType(data []byte) (bool, string) {
-	ct := http.DetectContentType(data)
-	if ct == "image/jpeg" || ct == "image/tiff" || ct == "image/webp" || ct == "image/gif" || ct == "image/png" || ct == "image/avif" {
-		return true, ct
-	}
-	return false, ct
-}